@@ -0,0 +1,26 @@
+package mstore
+
+import (
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// SetFSTypeProbe replaces the filesystem type probe and returns a function
+// restoring the original.
+func SetFSTypeProbe(probe func(path string) (uint32, error)) (restore func()) {
+	orig := fsTypeProbe
+	fsTypeProbe = probe
+	return func() { fsTypeProbe = orig }
+}
+
+// LoggerFor exposes the DiagLogger the background GC of d reports to.
+func LoggerFor(d *badger.DB) DiagLogger {
+	return loggerFor(d)
+}
+
+// Lookups returns how many keys have been read from the database by Set
+// and Get.
+func Lookups() uint64 {
+	return atomic.LoadUint64(&lookups)
+}
@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/base64"
-	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"reflect"
-
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -22,31 +24,81 @@ const (
 )
 
 var (
+	// mu guards the lifecycle of db. Operations hold it for reading while
+	// they use db; Init* and Close hold it for writing.
+	mu     sync.RWMutex
 	db     *badger.DB
 	isOpen bool
 )
 
-// Marshal takes in an CEvent and marshals it into a gob formatted byte slice..
+// rlock read-locks the store for an operation. When the store is not open
+// the lock is released again and an error returned.
+func rlock() error {
+	mu.RLock()
+	if !isOpen {
+		mu.RUnlock()
+		return ErrNotOpen
+	}
+	return nil
+}
+
+// wlock is rlock for an operation that writes to the store, failing with
+// ErrReadOnly when the store was opened read-only.
+func wlock() error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	if options.ReadOnly {
+		mu.RUnlock()
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// KVPair is a key and its value.
+type KVPair struct {
+	Key   []byte
+	Value []byte
+}
+
+// Entry is a stored key and its value, as listed by List and removed by
+// RemoveEntries. It is the same type as KVPair.
+type Entry = KVPair
+
+// KeyHash constructs the hash used by GenPK to derive keys from values. It
+// defaults to MD5 (16 byte keys) for compatibility with existing stores;
+// set it to sha256.New, or any other hash.Hash constructor, before the
+// store is initialized to change the key algorithm.
+var KeyHash func() hash.Hash = md5.New
+
+// Marshal encodes e with the configured Codec, gob by default. A nil value or
+// nil pointer is rejected. Both gob and JSON skip unexported struct fields,
+// so they are not stored, and gob refuses structs without exported fields.
 func Marshal(e interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(e); err != nil {
+	if e == nil {
+		return nil, errors.New("cannot marshal nil value")
+	}
+	if rv := reflect.ValueOf(e); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, errors.New("cannot marshal nil value")
+	}
+
+	data, err := codec.Marshal(e)
+	if err != nil {
 		return nil, fmt.Errorf("could not encode to bytes: %v", err)
 	}
-	return buf.Bytes(), nil
+	return data, nil
 }
 
-// Unmarshal parses the gob-encoded data and stores the result in the value pointed to by v.
+// Unmarshal decodes data with the configured Codec, gob by default, and
+// stores the result in the value pointed to by v.
 func Unmarshal(data []byte, v interface{}) (err error) {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return fmt.Errorf("v must be a pointer and not nil")
 	}
 	t := fmt.Sprintf("%T", v)
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
 
-	if err := dec.Decode(v); err != nil {
+	if err := codec.Unmarshal(data, v); err != nil {
 		return fmt.Errorf("could not unmarshal bytes to %s: %v", t, err)
 	}
 
@@ -55,52 +107,140 @@ func Unmarshal(data []byte, v interface{}) (err error) {
 
 // InitPersistentMode ensures that the data store is ready.
 func InitPersistentMode() error {
+	return InitPersistentModeWithOptions(Options{})
+}
+
+// InitPersistentModeWithOptions is InitPersistentMode configured by o.
+func InitPersistentModeWithOptions(o Options) error {
+	mu.Lock()
+	defer mu.Unlock()
+
 	if db != nil && !db.IsClosed() {
 		return errors.New("cannot renitialize db while it is still open")
 	}
 
-	opts := badger.
-		DefaultOptions(STORAGE_PATH).
-		WithSyncWrites(false)
+	path := o.Path
+	if path == "" {
+		path = STORAGE_PATH
+	}
+
+	if o.ForbidNetworkFS {
+		if err := checkNetworkFS(path); err != nil {
+			return err
+		}
+	}
 
-	opts.Logger = nil
+	opts, err := o.badgerOptions(badger.
+		DefaultOptions(path).
+		WithSyncWrites(false))
+	if err != nil {
+		return err
+	}
+
+	opts.Logger = o.Logger
 	d, err := badger.Open(opts)
 	if err != nil {
 		return err
 	}
-	go runGC()
+	if o.WarmCache {
+		warmCache(d)
+	}
 	db = d
+	options = o
+	window = newDedupWindow(o.DedupWindow)
+	lru = newLRUTracker(o.MaxEntries, o.MaxBytes)
+	if !o.ReadOnly {
+		startGC(d)
+	}
+	if o.OnExpire != nil {
+		sweeper = startExpirySweeper(d, o.OnExpire, o.ExpirySweepInterval)
+	}
 	isOpen = true
 	return nil
 }
 
+// InitPersistentModeEncrypted is InitPersistentMode storing the data under
+// path encrypted with key, which must be 16, 24 or 32 bytes long to select
+// AES-128, AES-192 or AES-256. See Options.EncryptionKey.
+func InitPersistentModeEncrypted(path string, key []byte) error {
+	if err := checkEncryptionKey(key); err != nil {
+		return err
+	}
+	return InitPersistentModeWithOptions(Options{Path: path, EncryptionKey: key})
+}
+
+// InitReadOnly opens the persistent store in path, which must exist, for
+// reading only. Functions that write to the store fail with ErrReadOnly and
+// no garbage collection runs. Several processes can open the same store
+// read-only at once, but not while it is open for writing.
+func InitReadOnly(path string) error {
+	return InitPersistentModeWithOptions(Options{Path: path, ReadOnly: true})
+}
+
 // InitDisklessMode ensures that the data store is a memory-only store.
 func InitDisklessMode() error {
+	return InitDisklessModeWithOptions(Options{})
+}
+
+// InitDisklessModeWithOptions is InitDisklessMode configured by o.
+func InitDisklessModeWithOptions(o Options) error {
+	mu.Lock()
+	defer mu.Unlock()
+
 	if db != nil && !db.IsClosed() {
 		return errors.New("cannot renitialize db while it is still open")
 	}
 
-	opts := badger.
+	opts, err := o.badgerOptions(badger.
 		DefaultOptions("").
-		WithInMemory(true)
+		WithInMemory(true))
+	if err != nil {
+		return err
+	}
 
-	opts.Logger = nil
+	opts.Logger = o.Logger
 
 	d, err := badger.Open(opts)
 	if err != nil {
 		return err
 	}
-	go runGC()
+	if o.WarmCache {
+		warmCache(d)
+	}
 	db = d
+	options = o
+	window = newDedupWindow(o.DedupWindow)
+	lru = newLRUTracker(o.MaxEntries, o.MaxBytes)
+	if !o.ReadOnly {
+		startGC(d)
+	}
+	if o.OnExpire != nil {
+		sweeper = startExpirySweeper(d, o.OnExpire, o.ExpirySweepInterval)
+	}
 	isOpen = true
 	return nil
 }
 
+// warmCache reads every key of d, without values, to populate badger's
+// caches.
+func warmCache(d *badger.DB) {
+	d.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+		}
+		return nil
+	})
+}
+
+// GenPK derives the primary key for the given data using KeyHash.
 func GenPK(data []byte) ([]byte, error) {
 	if len(data) == 0 {
 		return nil, errors.New("data for key is empty")
 	}
-	h := md5.New()
+	h := KeyHash()
 	_, err := h.Write(data)
 	if err != nil {
 		return nil, err
@@ -108,99 +248,549 @@ func GenPK(data []byte) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+// KeyLen reports the length of the keys GenPK derives with the current
+// KeyHash, 16 for the default MD5. Get does not enforce it, since keys given
+// to SetWithKey may have any non-zero length, but callers building keys
+// themselves can use it to check that they match the generated ones.
+func KeyLen() int {
+	return KeyHash().Size()
+}
+
+// KeyString returns the hex form of key used to display keys in logs and
+// error messages.
+func KeyString(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+// ParseKey parses a key from the form returned by KeyString.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %v", s, err)
+	}
+	return key, nil
+}
+
 // Set adds and event to to cache
-func Set(data []byte) ([]byte, error) {
-	if !isOpen {
-		return nil, errors.New("the storage is not open")
+func Set(data []byte) (key []byte, err error) {
+	defer func() { countOp(&opSets, err) }()
+	if err := wlock(); err != nil {
+		return nil, err
 	}
-	key, err := GenPK(data)
+	defer mu.RUnlock()
+
+	key, err = GenPK(data)
 	if err != nil {
 		return nil, err
 	}
 
-	if e, _ := Get(key); e != nil {
-		return nil, errors.New("the entity already exists")
-	}
+	return set(key, data, 0, nil)
+}
 
-	txn := db.NewTransaction(true)
+// set stores data under key, with the given user meta bits, unless the
+// entity already exists. An existing value is compared with same, or with
+// data when same is nil, to tell a duplicate from a key collision.
+func set(key, data []byte, meta byte, same func(stored []byte) bool) ([]byte, error) {
+	// Every write or removal of a key other than by Set forgets it, so a key
+	// in the window that has not expired is still stored with data.
+	if window.contains(key, data) && !options.IdempotentSet {
+		return nil, ErrAlreadyExists
+	}
 
-	if err := txn.Set(key, data); err != nil {
-		txn.Discard()
+	e, expiresAt, err := getExpiry(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return nil, err
 	}
+	if e != nil {
+		if same == nil {
+			same = func(stored []byte) bool { return bytes.Equal(stored, data) }
+		}
+		if !same(e) {
+			return nil, fmt.Errorf("%w: %s", ErrKeyCollision, KeyString(key))
+		}
+		window.add(key, data, expiresAt)
+		if options.IdempotentSet {
+			return key, nil
+		}
+		return nil, ErrAlreadyExists
+	}
 
-	if err := txn.Commit(); err != nil {
+	entry := newEntry(key, data)
+	entry.UserMeta |= meta
+	if err := put(entry); err != nil {
 		return nil, err
 	}
+	window.add(key, data, entry.ExpiresAt)
 
 	return key, nil
 }
 
+// SetBatch stores each of values under the key derived by GenPK, as Set
+// does, staging them in a single badger WriteBatch that is flushed once.
+// keys holds the key of each stored value by index, or nil where the value
+// was not stored, and errs reports why by index. A failing value does not
+// prevent the rest from being written.
+func SetBatch(values [][]byte) (keys [][]byte, errs map[int]error) {
+	if err := wlock(); err != nil {
+		return nil, batchErrors(len(values), err)
+	}
+	defer mu.RUnlock()
+
+	return setBatch(values, 0)
+}
+
+// SetBatchWithTTL is SetBatch storing every value for ttl, which must be
+// positive, so that the whole batch expires together.
+func SetBatchWithTTL(values [][]byte, ttl time.Duration) (keys [][]byte, errs map[int]error) {
+	if err := wlock(); err != nil {
+		return nil, batchErrors(len(values), err)
+	}
+	defer mu.RUnlock()
+
+	if ttl <= 0 {
+		return nil, batchErrors(len(values), fmt.Errorf("ttl must be positive, got %v", ttl))
+	}
+
+	return setBatch(values, ttl)
+}
+
+// batchErrors reports err for each of n values of a batch.
+func batchErrors(n int, err error) map[int]error {
+	errs := make(map[int]error, n)
+	for i := 0; i < n; i++ {
+		errs[i] = err
+	}
+	return errs
+}
+
+// setBatch implements SetBatch, storing the values for ttl unless it is
+// zero. The lock must be held.
+func setBatch(values [][]byte, ttl time.Duration) (keys [][]byte, errs map[int]error) {
+	errs = make(map[int]error)
+	keys = make([][]byte, len(values))
+	seen := make(map[string]bool, len(values))
+	for i, v := range values {
+		key, err := GenPK(v)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if seen[string(key)] {
+			errs[i] = fmt.Errorf("%w: duplicated in the batch", ErrAlreadyExists)
+			continue
+		}
+		seen[string(key)] = true
+		keys[i] = key
+	}
+
+	// stored holds the values that are already stored, which IdempotentSet
+	// reports as successful without writing them again.
+	stored := make(map[int]bool)
+	err := db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			if key == nil {
+				continue
+			}
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			keys[i] = nil
+			switch {
+			case !bytes.Equal(e, values[i]):
+				errs[i] = fmt.Errorf("%w: %s", ErrKeyCollision, KeyString(key))
+			case options.IdempotentSet:
+				keys[i] = key
+				stored[i] = true
+			default:
+				errs[i] = ErrAlreadyExists
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range values {
+			keys[i] = nil
+			errs[i] = err
+		}
+		return keys, errs
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	pending := make([]int, 0, len(values))
+	entries := make([]*badger.Entry, len(values))
+	for i, key := range keys {
+		if key == nil || stored[i] {
+			continue
+		}
+		entries[i] = newEntry(key, values[i])
+		if ttl > 0 {
+			entries[i] = entries[i].WithTTL(ttl)
+		}
+		if err := wb.SetEntry(entries[i]); err != nil {
+			keys[i] = nil
+			errs[i] = err
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	if err := wb.Flush(); err != nil {
+		for _, i := range pending {
+			keys[i] = nil
+			errs[i] = err
+		}
+		return keys, errs
+	}
+
+	for _, i := range pending {
+		window.add(keys[i], values[i], entries[i].ExpiresAt)
+	}
+
+	return keys, errs
+}
+
+// BulkLoad writes values under the keys derived by GenPK through a single
+// badger WriteBatch and returns the keys in the same order. It is meant for
+// initial loads: unlike Set and SetBatch it does not check whether entities
+// already exist, so existing values with the same key are overwritten.
+func BulkLoad(values [][]byte) ([][]byte, error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	keys := make([][]byte, len(values))
+	for i, v := range values {
+		key, err := GenPK(v)
+		if err != nil {
+			return nil, fmt.Errorf("value %d: %v", i, err)
+		}
+		keys[i] = key
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	entries := make([]*badger.Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = newEntry(key, values[i])
+		if err := wb.SetEntry(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		window.add(key, values[i], entries[i].ExpiresAt)
+	}
+	return keys, nil
+}
+
+// SetWithKey stores data under the caller supplied key instead of one
+// derived by GenPK, allowing mstore to be used as a general key/value store.
+// Like Set, it refuses to replace an entry that already exists.
+func SetWithKey(key, data []byte) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	e, err := get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if e != nil {
+		return ErrAlreadyExists
+	}
+
+	return put(newEntry(key, data))
+}
+
+// Upsert writes data under key whether or not the key already exists. Unlike
+// Set and SetWithKey, which refuse to replace an existing entity, Upsert
+// unconditionally overwrites the stored value in a single transaction.
+func Upsert(key, data []byte) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	return put(newEntry(key, data))
+}
+
 // SetWithTTL allows an item to be saved to the database, yet only exist
 // for the time set in the TTL. This allows for caching operations where
 // a cached item is only valid for a certain period of time.
 func SetWithTTL(data []byte, ttl time.Duration) ([]byte, error) {
-	if !isOpen {
-		return nil, errors.New("the storage is not open")
+	if err := wlock(); err != nil {
+		return nil, err
 	}
+	defer mu.RUnlock()
 
 	key, err := GenPK(data)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := put(newEntry(key, data).WithTTL(ttl)); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// SetWithExpiry stores data like SetWithTTL, but until the absolute time
+// expiresAt. Badger keeps expiry times in whole seconds, so the entry
+// expires at expiresAt rounded up to the next second, which is returned.
+// A time that is not in the future is rejected.
+func SetWithExpiry(data []byte, expiresAt time.Time) (key []byte, at time.Time, err error) {
+	if err := wlock(); err != nil {
+		return nil, time.Time{}, err
+	}
+	defer mu.RUnlock()
+
+	if !expiresAt.After(time.Now()) {
+		return nil, time.Time{}, fmt.Errorf("expiry %s is not in the future", expiresAt.Format(time.RFC3339))
+	}
+
+	key, err = GenPK(data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	at = expiresAt.Truncate(time.Second)
+	if at.Before(expiresAt) {
+		at = at.Add(time.Second)
+	}
+
+	entry := newEntry(key, data)
+	entry.ExpiresAt = uint64(at.Unix())
+	if err := put(entry); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return key, at, nil
+}
+
+// ReplacePrefix atomically replaces every entry under prefix with entries:
+// existing keys under prefix are deleted and entries are written in a single
+// transaction, so readers see either the old or the new set but never a mix.
+// Every entry key must start with prefix. The replacement is limited to what
+// fits in one badger transaction.
+func ReplacePrefix(prefix []byte, entries []KVPair) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(prefix) == 0 {
+		return errors.New("invalid prefix")
+	}
+
+	for _, e := range entries {
+		if !bytes.HasPrefix(e.Key, prefix) {
+			return fmt.Errorf("key %s is outside of prefix %s", KeyString(e.Key), KeyString(prefix))
+		}
+	}
+
+	err := db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		var old [][]byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			old = append(old, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		for _, k := range old {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, e := range entries {
+			if err := txn.SetEntry(newEntry(e.Key, e.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	window.reset()
+	return nil
+}
+
+// UpdateTTL sets the expiry of an existing entry to ttl from now, without
+// the caller resending its value, to support sliding expiration. Badger has
+// no way to change an entry's expiry alone, so the stored value is rewritten
+// internally along with its metadata.
+func UpdateTTL(key []byte, ttl time.Duration) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	if ttl <= 0 {
+		return errors.New("ttl must be greater than zero")
+	}
+
+	window.remove(key)
+	return db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return notFound(err)
+		}
+
+		raw, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		entry := badger.NewEntry(key, raw).WithMeta(item.UserMeta()).WithTTL(ttl)
+		return txn.SetEntry(entry)
+	})
+}
+
+// put writes a single entry in its own transaction.
+func put(entry *badger.Entry) error {
+	window.remove(entry.Key)
 	txn := db.NewTransaction(true)
-	entry := badger.NewEntry(key, data).WithTTL(ttl)
 	if err := txn.SetEntry(entry); err != nil {
 		txn.Discard()
-		return nil, err
+		return err
 	}
 
-	if err := txn.Commit(); err != nil {
+	return txn.Commit()
+}
+
+// Get retrieves the value from the data store.
+func Get(key []byte) (value []byte, err error) {
+	defer func() { countOp(&opGets, err) }()
+	if err := rlock(); err != nil {
 		return nil, err
 	}
+	defer mu.RUnlock()
 
-	return key, nil
+	return get(key)
 }
 
-// Get retrieves the value from the data store.
-func Get(key []byte) ([]byte, error) {
-	if !isOpen {
-		return nil, errors.New("the storage is not open")
-	}
+// get retrieves the value from the data store, which must be locked.
+func get(key []byte) ([]byte, error) {
+	value, _, err := getExpiry(key)
+	return value, err
+}
 
-	if len(key) != 16 {
-		return nil, errors.New("invalid key")
-	}
+// lookups counts the keys read from the database by get and getExpiry.
+var lookups uint64
 
-	var value []byte
+// getExpiry is get, also returning the badger expiry time of the entry,
+// zero when it does not expire.
+func getExpiry(key []byte) (value []byte, expiresAt uint64, err error) {
+	if len(key) == 0 {
+		return nil, 0, ErrInvalidKey
+	}
 
-	err := db.View(func(txn *badger.Txn) error {
+	atomic.AddUint64(&lookups, 1)
+	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
 		if err != nil {
-			return errors.New("key not found")
+			return missing(txn, key, err)
 		}
 
-		item.Value(func(val []byte) error {
-			value = append([]byte{}, val...)
-			return nil
-		})
+		value, err = itemValue(item)
+		if err == nil {
+			expiresAt = item.ExpiresAt()
+			lru.touch(key, txn.ReadTs())
+		}
+		return err
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, expiresAt, nil
+}
+
+// GetMany resolves keys within a single read transaction and returns the
+// values found, keyed like GetBatch. Keys that are not found or have expired
+// are absent from the result, empty keys are skipped, and a key given more
+// than once appears once.
+func GetMany(keys [][]byte) (me map[string][]byte, err error) {
+	if err := rlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
 
+	me = make(map[string][]byte, len(keys))
+	err = db.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			if len(key) == 0 {
+				continue
+			}
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			v, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			me[base64.StdEncoding.EncodeToString(key)] = v
+		}
 		return nil
 	})
-
 	if err != nil {
 		return nil, err
 	}
-	return value, nil
+	return
 }
 
+// GetBatch returns every entry in the store keyed by the base64 encoding of
+// its key. An entry whose value cannot be read does not fail the others: the
+// entries that were read are returned along with a *BatchError reporting the
+// rest. The base64 keys are kept only for backward compatibility; use
+// Entries for keys that can be passed straight back to Get and Remove, and
+// KeyString for displaying keys. The whole store is loaded into memory, so
+// use GetBatchPage, ForEach or Scan for stores that may be large.
 func GetBatch() (me map[string][]byte, err error) {
-	if !isOpen {
-		return nil, errors.New("the storage is not open")
+	if err := rlock(); err != nil {
+		return nil, err
 	}
+	defer mu.RUnlock()
 
 	me = make(map[string][]byte)
+	failed := make(map[string]error)
 	err = db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 100
@@ -209,23 +799,283 @@ func GetBatch() (me map[string][]byte, err error) {
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 			k := base64.StdEncoding.EncodeToString(item.Key())
-			err := item.Value(func(v []byte) error {
-				me[k] = (v)
+			v, err := itemValue(item)
+			if err != nil {
+				failed[k] = err
+				continue
+			}
+			me[k] = v
+		}
+		return nil
+	})
+	if err == nil && len(failed) > 0 {
+		err = &BatchError{Errs: failed}
+	}
+	return
+}
+
+// Entries returns every entry in the store in key order, with keys as stored
+// so they can be used with Get and Remove directly. Like GetBatch it loads
+// the whole store into memory.
+func Entries() (entries []KVPair, err error) {
+	if err := rlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 100
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, KVPair{Key: item.KeyCopy(nil), Value: v})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// List is Entries.
+func List() ([]Entry, error) {
+	return Entries()
+}
+
+// GetByPrefix returns every entry whose key starts with prefix, keyed like
+// GetBatch. The map is empty, not nil, when nothing matches.
+func GetByPrefix(prefix []byte) (me map[string][]byte, err error) {
+	if err := rlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	me = make(map[string][]byte)
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := base64.StdEncoding.EncodeToString(item.Key())
+			v, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			me[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// ForEach streams every entry in the store to fn, stopping at and returning
+// the first error fn returns, or nil when it is ErrStop. The key and value
+// are copies owned by the caller and remain valid after fn returns; Scan
+// avoids the copies.
+func ForEach(fn func(key, value []byte) error) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), v); err != nil {
+				if err == ErrStop {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Scan calls fn for every entry with a key in the range [start, end), in key
+// order, stopping at the first error fn returns, which is returned unless it
+// is ErrStop. A nil start begins at the first key and a nil end continues to
+// the last. The slices passed to fn are only valid until it returns; copy
+// them to retain them.
+func Scan(start, end []byte, fn func(k, v []byte) error) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			if end != nil && bytes.Compare(k, end) >= 0 {
 				return nil
+			}
+			err := item.Value(func(raw []byte) error {
+				v, _, err := decodeValue(item.UserMeta(), raw)
+				if err != nil {
+					return err
+				}
+				return fn(k, v)
 			})
+			if err == ErrStop {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetBatchPage returns at most limit entries whose keys sort after afterKey,
+// keyed like GetBatch. An empty afterKey starts at the beginning of the
+// store. The returned cursor is the afterKey for the next page and is nil
+// once there are no more entries.
+func GetBatchPage(afterKey []byte, limit int) (me map[string][]byte, next []byte, err error) {
+	if err := rlock(); err != nil {
+		return nil, nil, err
+	}
+	defer mu.RUnlock()
+
+	if limit <= 0 {
+		return nil, nil, errors.New("limit must be greater than zero")
+	}
+
+	me = make(map[string][]byte)
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		if limit < opts.PrefetchSize {
+			opts.PrefetchSize = limit
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Seek(afterKey)
+		if len(afterKey) > 0 && it.Valid() && bytes.Equal(it.Item().Key(), afterKey) {
+			it.Next()
+		}
+
+		var last []byte
+		for ; it.Valid(); it.Next() {
+			if len(me) == limit {
+				next = last
+				break
+			}
+			item := it.Item()
+			last = item.KeyCopy(nil)
+			v, err := itemValue(item)
 			if err != nil {
 				return err
 			}
+			me[base64.StdEncoding.EncodeToString(last)] = v
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 	return
 }
 
-// Removes an entry based on the given key.
+// GetBatchPaged is GetBatchPage: pass the returned cursor back to read the
+// next page, until it is empty.
+func GetBatchPaged(cursor []byte, limit int) (entries map[string][]byte, nextCursor []byte, err error) {
+	return GetBatchPage(cursor, limit)
+}
+
+// Keys returns a copy of every key in the store without loading any values.
+func Keys() ([][]byte, error) {
+	return KeysPrefix(nil)
+}
+
+// KeysPrefix returns a copy of every key starting with prefix without
+// loading any values.
+func KeysPrefix(prefix []byte) (keys [][]byte, err error) {
+	if err := rlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	keys = make([][]byte, 0)
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	return
+}
+
+// Count returns the number of entries in the store, walking only the keys.
+func Count() (int, error) {
+	return CountPrefix(nil)
+}
+
+// CountPrefix returns the number of entries whose key starts with prefix.
+func CountPrefix(prefix []byte) (n int, err error) {
+	if err := rlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	return count(prefix)
+}
+
+// count returns the number of entries whose key starts with prefix. The lock
+// must be held.
+func count(prefix []byte) (n int, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return
+}
+
+// Removes an entry based on the given key. Like Get, it rejects an empty key
+// with ErrInvalidKey; keys of any other length are valid, as SetWithKey
+// stores them.
 func Remove(key []byte) (err error) {
-	if !isOpen {
-		return errors.New("the storage is not open")
+	defer func() { countOp(&opRemoves, err) }()
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
 	}
 
 	txn := db.NewTransaction(true)
@@ -240,39 +1090,170 @@ func Remove(key []byte) (err error) {
 	if err != nil {
 		return
 	}
+	window.remove(key)
 	return
 }
 
-// Removes a batch of keys.
+// Removes a batch of keys in a single transaction. Either every key is
+// removed or, when any key cannot be deleted, none are; the keys that failed
+// are reported in errs keyed by the base64 encoding of the key, like the
+// results of GetBatch.
 func RemoveBatch(keys [][]byte) (ok bool, errs map[string]error) {
+	errs = make(map[string]error)
+	if err := wlock(); err != nil {
+		for _, k := range keys {
+			errs[base64.StdEncoding.EncodeToString(k)] = err
+		}
+		return false, errs
+	}
+	defer mu.RUnlock()
+
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
-	errs = make(map[string]error)
 
 	for _, k := range keys {
 		if len(k) == 0 {
 			continue
 		}
-		if err := Remove(k); err != nil {
-			key := base64.StdEncoding.EncodeToString(k)
-			errs[key] = err
+		if err := txn.Delete(k); err != nil {
+			errs[base64.StdEncoding.EncodeToString(k)] = err
 		}
 	}
 
-	return len(errs) == 0, errs
+	if len(errs) > 0 {
+		return false, errs
+	}
+
+	if err := txn.Commit(); err != nil {
+		for _, k := range keys {
+			if len(k) == 0 {
+				continue
+			}
+			errs[base64.StdEncoding.EncodeToString(k)] = err
+		}
+		return false, errs
+	}
+
+	for _, k := range keys {
+		window.remove(k)
+	}
+	return true, errs
+}
+
+// RemoveEntries is RemoveBatch for the keys of entries, such as those
+// returned by List. The values are ignored.
+func RemoveEntries(entries []Entry) (ok bool, errs map[string]error) {
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return RemoveBatch(keys)
+}
+
+// DropAll removes every entry from the store while keeping it open, which
+// also works in diskless mode. Writes are blocked while the data is dropped,
+// so concurrent writers wait or fail until DropAll returns; avoid calling it
+// while transactions are in flight.
+func DropAll() error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if err := db.DropAll(); err != nil {
+		return err
+	}
+	window.reset()
+	return nil
+}
+
+// DropPrefix removes every entry whose key starts with one of prefixes. It is
+// not an error when nothing matches. An empty prefix is rejected rather than
+// treated as matching everything; use DropAll for that.
+func DropPrefix(prefixes ...[]byte) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(prefixes) == 0 {
+		return nil
+	}
+	for _, p := range prefixes {
+		if len(p) == 0 {
+			return errors.New("invalid prefix")
+		}
+	}
+
+	if err := db.DropPrefix(prefixes...); err != nil {
+		return err
+	}
+	window.reset()
+	return nil
+}
+
+// Sync flushes committed writes to disk. Unless Options.SyncWrites is set,
+// commits are acknowledged before they are synced, so call Sync before
+// anything that relies on the files being complete, such as a filesystem
+// snapshot.
+func Sync() error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.Sync()
 }
 
 // IsOpen indicates if the internal database is open or not.
 func IsOpen() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
 	return isOpen
 }
 
+// Ping checks that the store is usable, not merely open, by running an empty
+// read transaction. It returns ErrNotOpen when the store is closed and the
+// error of the underlying database otherwise, which suits liveness probes.
+func Ping() error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.View(func(txn *badger.Txn) error {
+		return nil
+	})
+}
+
+// DB returns the underlying badger database and whether it is open. It is an
+// escape hatch for badger features mstore does not wrap; anything done
+// through it bypasses the package's key conventions and safety checks.
+func DB() (*badger.DB, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if !isOpen {
+		return nil, false
+	}
+	return db, true
+}
+
 // Close closes down the internal database.
 func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
 	if db == nil || db.IsClosed() {
 		isOpen = false
 		return nil
 	}
 	isOpen = false
+	sweeper.close()
+	sweeper = nil
+	stopGC()
+	stopMergeOperators()
+	stopWatches()
 	return db.Close()
 }
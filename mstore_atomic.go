@@ -0,0 +1,103 @@
+package mstore
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// maxConflictRetries bounds how often a read-modify-write operation is
+// retried when its transaction conflicts with a concurrent writer.
+const maxConflictRetries = 10
+
+// update runs fn in a read-write transaction, retrying it on conflicts. The
+// lock must be held.
+func update(fn func(txn *badger.Txn) error) (err error) {
+	for i := 0; i < maxConflictRetries; i++ {
+		if err = db.Update(fn); !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// Pop returns the value stored under key and removes the key in the same
+// transaction, so when several callers pop the same key only one of them
+// gets the value. ErrNotFound is returned when the key does not exist.
+func Pop(key []byte) (value []byte, err error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	err = update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return notFound(err)
+		}
+		if value, err = itemValue(item); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	window.remove(key)
+	return value, nil
+}
+
+// CompareAndSwap replaces the value stored under key with new when it
+// currently equals old, reporting whether the swap happened. A nil old
+// matches only a key that does not exist. The compare and the write happen
+// in one transaction, which is retried a bounded number of times when a
+// concurrent writer conflicts with it; badger.ErrConflict is returned when
+// the retries run out.
+func CompareAndSwap(key, old, new []byte) (swapped bool, err error) {
+	if err := wlock(); err != nil {
+		return false, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return false, ErrInvalidKey
+	}
+
+	err = update(func(txn *badger.Txn) error {
+		swapped = false
+		item, err := txn.Get(key)
+		switch {
+		case errors.Is(err, badger.ErrKeyNotFound):
+			if old != nil {
+				return nil
+			}
+		case err != nil:
+			return err
+		default:
+			current, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			if old == nil || !bytes.Equal(current, old) {
+				return nil
+			}
+		}
+		if err := txn.SetEntry(newEntry(key, new)); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if swapped {
+		window.remove(key)
+	}
+	return swapped, nil
+}
@@ -0,0 +1,51 @@
+package mstore
+
+import (
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Backup writes a consistent snapshot of the store to w using badger's native
+// backup format. Only entries written after version since are included, so
+// passing 0 dumps everything. The returned version can be passed as since on
+// a later call to take an incremental backup.
+func Backup(w io.Writer, since uint64) (uint64, error) {
+	if err := rlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	return db.Backup(w, since)
+}
+
+// Restore loads a backup written by Backup into the store. The store must be
+// open and empty; restoring over existing data is refused with ErrNotEmpty
+// rather than merged, so an incremental backup can only be applied on top of
+// its base through the badger database returned by DB.
+func Restore(r io.Reader) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !empty {
+		return ErrNotEmpty
+	}
+
+	return db.Load(r, 256)
+}
@@ -0,0 +1,105 @@
+package mstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// call tracks a single in-flight GetOrCompute for a key so that concurrent
+// callers wait on its result rather than computing it again.
+type call struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+var (
+	callsMu sync.Mutex
+	calls   = make(map[string]*call)
+)
+
+// GetOrCompute returns the value stored under key or, on a miss, invokes
+// compute, stores its result under key for ttl and returns it. A ttl of zero
+// stores the result with Options.DefaultTTL, without expiry by default.
+// Concurrent callers for the same missing key wait for a single invocation
+// of compute and share its result.
+func GetOrCompute(key []byte, ttl time.Duration, compute func() ([]byte, error)) ([]byte, error) {
+	if compute == nil {
+		return nil, errors.New("compute function is nil")
+	}
+
+	v, err := Get(key)
+	if err == nil {
+		return v, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	k := string(key)
+	callsMu.Lock()
+	if c, ok := calls[k]; ok {
+		callsMu.Unlock()
+		c.wg.Wait()
+		if c.err != nil {
+			return nil, c.err
+		}
+		return append([]byte{}, c.val...), nil
+	}
+	// err is overwritten by fill, so waiters only see it if compute panics.
+	c := &call{err: errors.New("compute function panicked")}
+	c.wg.Add(1)
+	calls[k] = c
+	callsMu.Unlock()
+
+	defer func() {
+		callsMu.Lock()
+		delete(calls, k)
+		callsMu.Unlock()
+	}()
+	defer c.wg.Done()
+
+	c.val, c.err = fill(key, ttl, compute)
+	return c.val, c.err
+}
+
+// GetOrSet returns the value stored under key or, on a miss, stores and
+// returns the result of compute with Options.DefaultTTL, without an expiry by
+// default. Like GetOrCompute, concurrent callers for the same key share a
+// single call to compute.
+func GetOrSet(key []byte, compute func() ([]byte, error)) ([]byte, error) {
+	return GetOrCompute(key, 0, compute)
+}
+
+// fill computes and stores the value for a missing key. The key is checked
+// again first in case another caller stored it since the initial miss.
+func fill(key []byte, ttl time.Duration, compute func() ([]byte, error)) ([]byte, error) {
+	v, err := Get(key)
+	if err == nil {
+		return v, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	v, err = compute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	entry := newEntry(key, v)
+	if ttl > 0 {
+		entry = entry.WithTTL(ttl)
+	}
+	if err := put(entry); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
@@ -0,0 +1,158 @@
+package mstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// Codec converts values to and from the bytes held in the store. It is used
+// by Marshal and Unmarshal.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// GobCodec encodes values with encoding/gob. It is the default Codec.
+type GobCodec struct{}
+
+// Marshal encodes v as gob.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes gob data into v.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+// RegisterType registers the concrete types of values with gob, so that
+// values of those types can be stored in interface fields by the GobCodec.
+// Call it once at startup, before Marshal or Unmarshal are used with the
+// types, and register the same types in every process reading the data. It
+// panics, as gob.Register does, when a type is registered under two names.
+func RegisterType(values ...interface{}) {
+	for _, v := range values {
+		gob.Register(v)
+	}
+}
+
+// JSONCodec encodes values with encoding/json, which is readable by services
+// that are not written in Go.
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var codec Codec = GobCodec{}
+
+// SetCodec changes the Codec used by Marshal and Unmarshal. Passing nil
+// restores the default GobCodec. Values written with one codec can only be
+// read back with the same codec.
+func SetCodec(c Codec) {
+	if c == nil {
+		c = GobCodec{}
+	}
+	codec = c
+}
+
+// Flags prefixed to every value written by SetValue.
+const (
+	valuePlain byte = iota
+	valueGzip
+)
+
+// SetValue marshals v with the configured Codec and stores it as Set does,
+// gzipping it first when it is larger than Options.CompressValuesOver. The
+// key is derived from the uncompressed bytes so deduplication does not
+// depend on compression. Values stored by SetValue carry a flag byte and
+// must be read back with GetValue.
+func SetValue(v interface{}) ([]byte, error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	data, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := GenPK(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := append([]byte{valuePlain}, data...)
+	if options.CompressValuesOver > 0 && len(data) > options.CompressValuesOver {
+		var buf bytes.Buffer
+		buf.WriteByte(valueGzip)
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		stored = buf.Bytes()
+	}
+
+	return set(key, stored, 0, func(e []byte) bool {
+		d, err := valueData(e)
+		return err == nil && bytes.Equal(d, data)
+	})
+}
+
+// GetValue retrieves a value stored by SetValue and unmarshals it into v.
+func GetValue(key []byte, v interface{}) error {
+	stored, err := Get(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := valueData(stored)
+	if err != nil {
+		return err
+	}
+
+	return Unmarshal(data, v)
+}
+
+// valueData strips the flag byte SetValue prefixes to stored and
+// decompresses the rest if needed.
+func valueData(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errors.New("value was not stored by SetValue")
+	}
+
+	data := stored[1:]
+	switch stored[0] {
+	case valuePlain:
+	case valueGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("value was not stored by SetValue")
+	}
+
+	return data, nil
+}
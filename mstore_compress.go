@@ -0,0 +1,124 @@
+package mstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	badgeroptions "github.com/dgraph-io/badger/v3/options"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how values are compressed before they are stored.
+type Compression byte
+
+// Supported values of Options.Compression. The value is recorded with every
+// compressed entry, so the option can be changed between runs and values
+// written with any algorithm are still read back.
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", byte(c))
+}
+
+// TableCompression selects how badger compresses the blocks of its on-disk
+// tables, as opposed to Compression, which compresses each value.
+type TableCompression byte
+
+// Supported values of Options.TableCompression. Each table records how it
+// was compressed, so the option can be changed between runs.
+const (
+	// TableCompressionDefault keeps badger's default, Snappy.
+	TableCompressionDefault TableCompression = iota
+	TableCompressionNone
+	TableCompressionSnappy
+	TableCompressionZstd
+)
+
+func (c TableCompression) String() string {
+	switch c {
+	case TableCompressionDefault:
+		return "default"
+	case TableCompressionNone:
+		return "none"
+	case TableCompressionSnappy:
+		return "snappy"
+	case TableCompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("TableCompression(%d)", byte(c))
+}
+
+// badgerType returns the badger compression type c selects.
+func (c TableCompression) badgerType() (badgeroptions.CompressionType, error) {
+	switch c {
+	case TableCompressionNone:
+		return badgeroptions.None, nil
+	case TableCompressionSnappy:
+		return badgeroptions.Snappy, nil
+	case TableCompressionZstd:
+		return badgeroptions.ZSTD, nil
+	}
+	return 0, fmt.Errorf("unknown table compression %v", c)
+}
+
+// The zstd encoder and decoder are safe for concurrent use and expensive to
+// create, so they are shared and created on first use. Creating them only
+// fails for invalid options, which are not used here.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+// compress returns data compressed with c and prefixed with c, and whether
+// that is worth storing, which it is not when it saves no space.
+func compress(c Compression, data []byte) ([]byte, bool) {
+	out := []byte{byte(c)}
+	switch c {
+	case CompressionSnappy:
+		out = append(out, snappy.Encode(nil, data)...)
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		out = zstdEncoder.EncodeAll(data, out)
+	default:
+		return data, false
+	}
+	if len(out) >= len(data) {
+		return data, false
+	}
+	return out, true
+}
+
+// decompress reverses compress.
+func decompress(framed []byte) ([]byte, error) {
+	if len(framed) == 0 {
+		return nil, errors.New("stored value is corrupt")
+	}
+	switch Compression(framed[0]) {
+	case CompressionSnappy:
+		return snappy.Decode(nil, framed[1:])
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(framed[1:], nil)
+	}
+	return nil, fmt.Errorf("stored value uses unknown compression %d", framed[0])
+}
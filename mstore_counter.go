@@ -0,0 +1,95 @@
+package mstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// errNotCounter is returned when a counter key holds a value that is not an
+// 8-byte big-endian int64.
+var errNotCounter = errors.New("the stored value is not a counter")
+
+// counterMu serializes increments, so that they do not conflict with each
+// other and only need to be retried for other writers of the same key.
+var counterMu sync.Mutex
+
+// Increment adds delta, which may be negative, to the counter stored under
+// key and returns its new value. The counter is read, added to and written
+// back in a single transaction, so concurrent callers never lose each
+// other's increments. A counter that was never incremented is zero, while a
+// key holding any other value is left as it is and an error is returned.
+//
+// A counter's value is an 8-byte big-endian int64, which can also be read
+// with Get.
+func Increment(key []byte, delta int64) (n int64, err error) {
+	if err := wlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return 0, ErrInvalidKey
+	}
+
+	counterMu.Lock()
+	defer counterMu.Unlock()
+
+	err = update(func(txn *badger.Txn) error {
+		old, err := readCounter(txn, key)
+		if err != nil {
+			return err
+		}
+		n = old + delta
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(n))
+		return txn.Set(key, value)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	window.remove(key)
+	return n, nil
+}
+
+// Counter returns the current value of the counter stored under key, which is
+// zero when it was never incremented.
+func Counter(key []byte) (n int64, err error) {
+	if err := rlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return 0, ErrInvalidKey
+	}
+
+	err = db.View(func(txn *badger.Txn) (err error) {
+		n, err = readCounter(txn, key)
+		return err
+	})
+	return n, err
+}
+
+// readCounter reads the counter stored under key, which is zero when the key
+// does not exist.
+func readCounter(txn *badger.Txn, key []byte) (int64, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 || item.UserMeta() != 0 {
+		return 0, errNotCounter
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
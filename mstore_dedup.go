@@ -0,0 +1,122 @@
+package mstore
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// dedupWindow remembers the most recently stored keys, with a fingerprint of
+// their values and when they expire, so that Set can reject duplicates
+// without reading the database. A nil window is disabled and all of its
+// methods are no-ops.
+type dedupWindow struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+// window is the dedup window of the open store, nil unless
+// Options.DedupWindow is set.
+var window *dedupWindow
+
+func newDedupWindow(size int) *dedupWindow {
+	if size <= 0 {
+		return nil
+	}
+	return &dedupWindow{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element, size),
+	}
+}
+
+// windowEntry is a key in the window, the fingerprint of its value and the
+// badger expiry time of the entry, zero when it does not expire.
+type windowEntry struct {
+	key       string
+	sum       uint64
+	expiresAt uint64
+}
+
+// fingerprint returns a checksum of data, independent of the key hash, used
+// to tell a duplicate from a key collision.
+func fingerprint(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// contains reports whether key was recently stored with data and has not
+// expired since, and marks it as used.
+func (w *dedupWindow) contains(key, data []byte) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.keys[string(key)]
+	if !ok {
+		return false
+	}
+	w.order.MoveToFront(e)
+	we := e.Value.(windowEntry)
+	if we.expiresAt != 0 && uint64(time.Now().Unix()) >= we.expiresAt {
+		return false
+	}
+	return we.sum == fingerprint(data)
+}
+
+// add records key stored with data until expiresAt, evicting the least
+// recently used key when the window is full.
+func (w *dedupWindow) add(key, data []byte, expiresAt uint64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	k := string(key)
+	we := windowEntry{key: k, sum: fingerprint(data), expiresAt: expiresAt}
+	if e, ok := w.keys[k]; ok {
+		e.Value = we
+		w.order.MoveToFront(e)
+		return
+	}
+	w.keys[k] = w.order.PushFront(we)
+	if w.order.Len() > w.size {
+		oldest := w.order.Back()
+		w.order.Remove(oldest)
+		delete(w.keys, oldest.Value.(windowEntry).key)
+	}
+}
+
+// remove forgets key, which must be done whenever it is deleted or written
+// other than by Set so the window never reports a key that may be gone.
+func (w *dedupWindow) remove(key []byte) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if e, ok := w.keys[string(key)]; ok {
+		w.order.Remove(e)
+		delete(w.keys, string(key))
+	}
+}
+
+// reset forgets every key.
+func (w *dedupWindow) reset() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.order.Init()
+	w.keys = make(map[string]*list.Element, w.size)
+}
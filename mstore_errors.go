@@ -0,0 +1,129 @@
+package mstore
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Errors returned by the store. Use errors.Is to test for them, as they may
+// be wrapped with more context.
+var (
+	// ErrNotOpen is returned when the store is used before it is
+	// initialized or after it is closed.
+	ErrNotOpen = errors.New("the storage is not open")
+
+	// ErrStoreClosed is an alias of ErrNotOpen.
+	ErrStoreClosed = ErrNotOpen
+
+	// ErrReadOnly is returned by functions that write to the store when it
+	// was opened with InitReadOnly.
+	ErrReadOnly = errors.New("the storage is read-only")
+
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrExpired is returned when a key's TTL has lapsed. It also matches
+	// ErrNotFound. Once badger has compacted the expired entry away, the key
+	// is reported as ErrNotFound only.
+	ErrExpired = errors.New("key expired")
+
+	// ErrInvalidKey is returned when a key is empty.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrAlreadyExists is returned when writing an entity that is
+	// already stored.
+	ErrAlreadyExists = errors.New("the entity already exists")
+
+	// ErrKeyCollision is returned by Set and SetBatch when the key derived
+	// from a value is already stored for a different value. Keys found in
+	// the dedup window are reported as ErrAlreadyExists without comparing
+	// the values.
+	ErrKeyCollision = errors.New("key collision with a different value")
+
+	// ErrNetworkFS is returned by InitPersistentModeWithOptions when
+	// Options.ForbidNetworkFS is set and the store path is on a network
+	// filesystem.
+	ErrNetworkFS = errors.New("the storage path is on a network filesystem")
+
+	// ErrNotEmpty is returned by Restore when the store already holds data.
+	ErrNotEmpty = errors.New("the storage is not empty")
+
+	// ErrStop can be returned by the function passed to ForEach or Scan to
+	// stop iterating early. It is not an error, so the iteration returns
+	// nil.
+	ErrStop = errors.New("stop iteration")
+
+	// ErrNoGarbage is returned by RunGC when there was no value log file
+	// worth rewriting.
+	ErrNoGarbage = errors.New("no garbage to collect")
+)
+
+// BatchError reports the entries a batch operation failed on while the rest
+// succeeded. Errs maps the base64 encoding of each failed key, as GetBatch
+// keys its results, to its error. The message shows keys by KeyString.
+type BatchError struct {
+	Errs map[string]error
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Errs) == 1 {
+		for k, err := range e.Errs {
+			if key, derr := base64.StdEncoding.DecodeString(k); derr == nil {
+				k = KeyString(key)
+			}
+			return fmt.Sprintf("%s: %v", k, err)
+		}
+	}
+	return fmt.Sprintf("%d entries failed", len(e.Errs))
+}
+
+// wrappedError layers one of the errors above on top of the badger error
+// that caused it, so that errors.Is matches either of them.
+type wrappedError struct {
+	sentinel error
+	cause    error
+}
+
+func (e *wrappedError) Error() string        { return e.sentinel.Error() }
+func (e *wrappedError) Is(target error) bool { return target == e.sentinel }
+func (e *wrappedError) Unwrap() error        { return e.cause }
+
+// notFound turns a badger.ErrKeyNotFound returned by a lookup into
+// ErrNotFound, still matching the badger error. Any other error, such as a
+// failure to read the value, is returned as is.
+func notFound(err error) error {
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return &wrappedError{sentinel: ErrNotFound, cause: err}
+	}
+	return err
+}
+
+// missing is notFound for a failed lookup of key in txn, returning
+// ErrExpired instead when the latest version of key is still present but
+// past its TTL.
+func missing(txn *badger.Txn, key []byte, err error) error {
+	err = notFound(err)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.PrefetchValues = false
+	it := txn.NewKeyIterator(key, opts)
+	defer it.Close()
+
+	it.Rewind()
+	if !it.Valid() {
+		return err
+	}
+	exp := it.Item().ExpiresAt()
+	if exp != 0 && exp <= uint64(time.Now().Unix()) {
+		return &wrappedError{sentinel: ErrExpired, cause: err}
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package mstore
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// lruTracker bounds the store to Options.MaxEntries and Options.MaxBytes by
+// evicting the least recently used keys. Recency is measured in badger
+// versions: a key was last used at the version it was written with or at the
+// read timestamp it was last read at, whichever is later. Writes therefore
+// need no tracking and only reads are recorded, in memory. A nil tracker is
+// disabled and all of its methods are no-ops.
+type lruTracker struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu    sync.Mutex
+	reads map[string]uint64
+
+	// sweepMu serializes evictions.
+	sweepMu sync.Mutex
+}
+
+// lru is the tracker of the open store, nil unless Options.MaxEntries or
+// Options.MaxBytes is set.
+var lru *lruTracker
+
+func newLRUTracker(maxEntries int, maxBytes int64) *lruTracker {
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return nil
+	}
+	return &lruTracker{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		reads:      make(map[string]uint64),
+	}
+}
+
+// touch records that key was read at the read timestamp ts.
+func (l *lruTracker) touch(key []byte, ts uint64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ts > l.reads[string(key)] {
+		l.reads[string(key)] = ts
+	}
+}
+
+// lastRead returns the read timestamp key was last read at, or zero.
+func (l *lruTracker) lastRead(key []byte) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.reads[string(key)]
+}
+
+// forget drops the reads of the keys that were not seen by a sweep at the
+// read timestamp ts, as they have been deleted since they were read.
+func (l *lruTracker) forget(seen map[string]bool, ts uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, r := range l.reads {
+		if !seen[k] && r <= ts {
+			delete(l.reads, k)
+		}
+	}
+}
+
+// lruItem is a key considered for eviction, or a stream: its manifest and
+// all of its chunks, which are only evicted together.
+type lruItem struct {
+	keys    [][]byte
+	size    int64
+	recency uint64
+}
+
+// evict deletes the least recently used keys of d until it is within the
+// limits of the tracker l, and returns how many were deleted.
+func evict(d *badger.DB, l *lruTracker) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	l.sweepMu.Lock()
+	defer l.sweepMu.Unlock()
+
+	var (
+		items   []lruItem
+		entries int
+		total   int64
+		ts      uint64
+	)
+	seen := make(map[string]bool)
+	// owner maps the chunk keys of every stream to the index of the item of
+	// its manifest.
+	owner := make(map[string]int)
+	err := d.View(func(txn *badger.Txn) error {
+		ts = txn.ReadTs()
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			recency := item.Version()
+			if r := l.lastRead(key); r > 0 {
+				seen[string(key)] = true
+				if r > recency {
+					recency = r
+				}
+			}
+			size := item.EstimatedSize()
+			entries++
+			total += size
+
+			// a manifest sorts before its chunks, so they join its item
+			if i, ok := owner[string(key)]; ok {
+				items[i].keys = append(items[i].keys, key)
+				items[i].size += size
+				if recency > items[i].recency {
+					items[i].recency = recency
+				}
+				continue
+			}
+			if item.UserMeta()&metaStream != 0 {
+				// a manifest that cannot be read is evicted on its own
+				n, _ := streamChunks(txn, key)
+				for c := uint64(0); c < n; c++ {
+					owner[string(chunkKey(key, c))] = len(items)
+				}
+			}
+			items = append(items, lruItem{keys: [][]byte{key}, size: size, recency: recency})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	l.forget(seen, ts)
+
+	over := func() bool {
+		return (l.maxEntries > 0 && entries > l.maxEntries) ||
+			(l.maxBytes > 0 && total > l.maxBytes)
+	}
+	if !over() {
+		return 0, nil
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].recency < items[j].recency
+	})
+
+	// A key rewritten since the scan is deleted all the same, as if its
+	// write had happened just before the sweep.
+	wb := d.NewWriteBatch()
+	defer wb.Cancel()
+
+	n, deleted := 0, 0
+	for ; n < len(items) && over(); n++ {
+		for _, key := range items[n].keys {
+			if err := wb.Delete(key); err != nil {
+				return 0, err
+			}
+		}
+		deleted += len(items[n].keys)
+		entries -= len(items[n].keys)
+		total -= items[n].size
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	for _, item := range items[:n] {
+		for _, key := range item.keys {
+			window.remove(key)
+			delete(l.reads, string(key))
+		}
+	}
+	l.mu.Unlock()
+
+	return deleted, nil
+}
+
+// Evict deletes the least recently used entries until the store is within
+// Options.MaxEntries and Options.MaxBytes, and returns how many entries were
+// deleted. The limits are otherwise enforced every GC_INTERVAL by the
+// background GC, so Evict can be called after a burst of writes to enforce
+// them sooner. It does nothing when neither limit is set.
+func Evict() (int, error) {
+	if err := wlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	return evict(db, lru)
+}
@@ -0,0 +1,150 @@
+package mstore
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// defaultExpirySweepInterval is the sweep interval used when
+// Options.ExpirySweepInterval is zero.
+const defaultExpirySweepInterval = time.Second
+
+// expirySweeper calls Options.OnExpire for entries whose TTL is about to
+// lapse or has lapsed since the previous sweep. Callbacks run outside of any
+// lock, so they may call back into the package.
+type expirySweeper struct {
+	d        *badger.DB
+	onExpire func(key []byte)
+	interval time.Duration
+	started  int64
+	stop     chan struct{}
+
+	// mu is held while d is scanned, so that close can wait for a scan to
+	// finish before the database is closed.
+	mu      sync.Mutex
+	stopped bool
+
+	// notified holds the expiry time each key was reported for, so an
+	// entry is reported once unless its TTL changes.
+	notified map[string]uint64
+}
+
+// sweeper is the expiry sweeper of the open store, nil unless
+// Options.OnExpire is set. It is guarded by mu.
+var sweeper *expirySweeper
+
+// startExpirySweeper starts calling onExpire for the expiring entries of d
+// every interval.
+func startExpirySweeper(d *badger.DB, onExpire func(key []byte), interval time.Duration) *expirySweeper {
+	if interval == 0 {
+		interval = defaultExpirySweepInterval
+	}
+	s := &expirySweeper{
+		d:        d,
+		onExpire: onExpire,
+		interval: interval,
+		started:  time.Now().Unix(),
+		stop:     make(chan struct{}),
+		notified: make(map[string]uint64),
+	}
+	go s.run()
+	return s
+}
+
+// close stops the sweeper, waiting for a scan in progress but not for
+// callbacks, which may still be running when it returns.
+func (s *expirySweeper) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	close(s.stop)
+}
+
+func (s *expirySweeper) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		keys, err := s.scan()
+		if err != nil {
+			loggerFor(s.d).Error(err, "data store expiry sweep failed")
+			continue
+		}
+		for _, key := range keys {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			s.onExpire(key)
+		}
+	}
+}
+
+// scan returns the keys that expire before the next sweep, or have expired
+// since the sweeper started, and have not been reported yet.
+func (s *expirySweeper) scan() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil, nil
+	}
+
+	horizon := uint64(time.Now().Add(s.interval).Unix()) + 1
+	var due [][]byte
+	seen := make(map[string]bool, len(s.notified))
+	err := s.d.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.AllVersions = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var last []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			// only the latest version of a key matters
+			if last != nil && bytes.Equal(item.Key(), last) {
+				continue
+			}
+			last = item.KeyCopy(last[:0])
+
+			exp := item.ExpiresAt()
+			if exp == 0 || exp > horizon || int64(exp) < s.started {
+				continue
+			}
+			k := string(last)
+			seen[k] = true
+			if s.notified[k] == exp {
+				continue
+			}
+			s.notified[k] = exp
+			due = append(due, item.KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range s.notified {
+		if !seen[k] {
+			delete(s.notified, k)
+		}
+	}
+	return due, nil
+}
@@ -0,0 +1,34 @@
+package mstore
+
+import "fmt"
+
+// Filesystem magic numbers, as reported by statfs(2), of network
+// filesystems whose locking semantics are unsafe for badger.
+var networkFSTypes = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x564c:     "ncp",
+	0x73757245: "coda",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+}
+
+// fsTypeProbe reports the filesystem type of a path. It is a variable so
+// tests can simulate a network filesystem.
+var fsTypeProbe = statfsType
+
+// checkNetworkFS returns ErrNetworkFS when path is on a known network
+// filesystem.
+func checkNetworkFS(path string) error {
+	t, err := fsTypeProbe(path)
+	if err != nil {
+		return err
+	}
+	if name, ok := networkFSTypes[t]; ok {
+		return fmt.Errorf("%w: %s is on %s", ErrNetworkFS, path, name)
+	}
+	return nil
+}
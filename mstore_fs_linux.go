@@ -0,0 +1,24 @@
+package mstore
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// statfsType returns the filesystem magic number of the filesystem holding
+// path, probing the nearest existing parent when path does not exist yet.
+func statfsType(path string) (uint32, error) {
+	var st syscall.Statfs_t
+	for {
+		err := syscall.Statfs(path, &st)
+		if err == nil {
+			return uint32(st.Type), nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
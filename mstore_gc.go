@@ -1,25 +1,204 @@
 package mstore
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// gcStop and gcDone coordinate shutting down the GC goroutine of the open
+// store. They are guarded by mu.
+var (
+	gcStop chan struct{}
+	gcDone chan struct{}
 )
 
-func runGC() {
+// gcRuns and gcRewrites count the value log GC passes and the value log
+// files rewritten since the store was opened. They are reported by Stats.
+var (
+	gcRuns     uint64
+	gcRewrites uint64
+)
+
+// startGC starts the periodic value log GC of d. The lock must be held.
+func startGC(d *badger.DB) {
+	atomic.StoreUint64(&gcRuns, 0)
+	atomic.StoreUint64(&gcRewrites, 0)
+	gcStop = make(chan struct{})
+	gcDone = make(chan struct{})
+	go runGC(d, gcStop, gcDone)
+}
+
+// stopGC signals the GC goroutine to exit and waits until it has, so that
+// the database can be closed safely. The lock must be held.
+func stopGC() {
+	if gcStop == nil {
+		return
+	}
+	close(gcStop)
+	<-gcDone
+	gcStop, gcDone = nil, nil
+}
+
+func runGC(d *badger.DB, stop <-chan struct{}, done chan<- struct{}) {
 	ticker := time.NewTicker(GC_INTERVAL)
 	defer func() {
 		ticker.Stop()
+		close(done)
 	}()
 
-	for range ticker.C {
-	again:
-		if err := db.RunValueLogGC(DISCARD_RATIO); err != nil {
-			msg := "data store garbage collection failed"
-			// logger.Error(err, &msg)
-			log.Print(msg)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		logger := loggerFor(d)
+		if n, err := evict(d, lru); err != nil {
+			logger.Error(err, "data store eviction failed")
+		} else if n > 0 {
+			logger.Info(fmt.Sprintf("data store evicted %d entries", n))
+		}
+		if err := collectGarbage(d, DISCARD_RATIO); err != nil {
+			logger.Error(err, "data store garbage collection failed")
 		} else {
-			goto again
+			logger.Debug("data store garbage collection finished")
+		}
+		d.Sync()
+	}
+}
+
+// collectGarbage runs value log GC on d for as long as it keeps reclaiming
+// space, returning nil once badger reports there is nothing left to rewrite.
+func collectGarbage(d *badger.DB, ratio float64) error {
+	atomic.AddUint64(&gcRuns, 1)
+	for {
+		switch err := d.RunValueLogGC(ratio); err {
+		case nil:
+			atomic.AddUint64(&gcRewrites, 1)
+			continue
+		case badger.ErrNoRewrite, badger.ErrGCInMemoryMode:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// RunGC runs a single value log GC pass, rewriting at most one value log file
+// whose share of discardable data is at least discardRatio, which must be
+// between 0 and 1 exclusive. ErrNoGarbage is returned when no file qualified
+// and in diskless mode, where there is no value log.
+func RunGC(discardRatio float64) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return fmt.Errorf("discard ratio must be between 0 and 1, got %v", discardRatio)
+	}
+
+	atomic.AddUint64(&gcRuns, 1)
+	switch err := db.RunValueLogGC(discardRatio); err {
+	case nil:
+		atomic.AddUint64(&gcRewrites, 1)
+		return nil
+	case badger.ErrNoRewrite, badger.ErrGCInMemoryMode:
+		return ErrNoGarbage
+	default:
+		return err
+	}
+}
+
+// RunGCWithRatio runs the reclaim loop of the background GC on demand,
+// rewriting value log files for as long as one has a share of discardable
+// data of at least ratio, which must be between 0 and 1 exclusive. Unlike
+// RunGC it returns nil once there is nothing left to collect, including in
+// diskless mode. badger.ErrRejected is returned when a background GC pass
+// is running at the same time.
+func RunGCWithRatio(ratio float64) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if ratio <= 0 || ratio >= 1 {
+		return fmt.Errorf("discard ratio must be between 0 and 1, got %v", ratio)
+	}
+
+	return collectGarbage(db, ratio)
+}
+
+// Compact flattens the LSM tree into a single level using workers
+// concurrent compactions, so that reads touch fewer tables and space held by
+// overwritten and deleted keys is released. It is expensive, so run it in a
+// maintenance window, for example before a backup. It complements the value
+// log GC and is not available in diskless mode.
+func Compact(workers int) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if workers <= 0 {
+		return errors.New("workers must be greater than zero")
+	}
+	if db.Opts().InMemory {
+		return errors.New("compaction is not supported in diskless mode")
+	}
+
+	return db.Flatten(workers)
+}
+
+// Flatten is Compact, named after badger's DB.Flatten.
+func Flatten(workers int) error {
+	return Compact(workers)
+}
+
+// PurgePrefix drops every key starting with prefix and then runs value log
+// garbage collection so the space is reclaimed immediately rather than on
+// the next GC_INTERVAL. The returned size is the estimated number of bytes
+// held by the dropped entries, before they were dropped; how much of it GC
+// reclaims on disk depends on how the entries are spread over the value log
+// files. When a background GC pass is running at the same time, GC is left
+// to it and the drop still succeeds.
+func PurgePrefix(prefix []byte) (dropped int64, err error) {
+	if err := wlock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	if len(prefix) == 0 {
+		return 0, errors.New("invalid prefix")
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			dropped += it.Item().EstimatedSize()
 		}
-		db.Sync()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.DropPrefix(prefix); err != nil {
+		return 0, err
+	}
+	window.reset()
+
+	err = collectGarbage(db, DISCARD_RATIO)
+	if err != nil && !errors.Is(err, badger.ErrRejected) {
+		return dropped, err
 	}
+	return dropped, nil
 }
@@ -0,0 +1,109 @@
+package mstore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// DiagLogger receives mstore's own diagnostics, such as the failures of the
+// background GC, so they can be routed into a service's structured logging.
+// Unlike Options.Logger it does not receive badger's diagnostics.
+// Implementations must be safe for concurrent use.
+type DiagLogger interface {
+	Debug(msg string)
+	Info(msg string)
+	Error(err error, msg string)
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   DiagLogger
+)
+
+// SetLogger sets the DiagLogger mstore reports its diagnostics to. Until one is
+// set, or after passing nil, they go to Options.Logger if the store has one
+// and are discarded otherwise.
+func SetLogger(l DiagLogger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
+	logger = l
+}
+
+// loggerFor returns the DiagLogger for diagnostics about d: the one set by
+// SetLogger, an adapter to the badger.Logger d was opened with, or a
+// DiagLogger discarding them.
+func loggerFor(d *badger.DB) DiagLogger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+
+	if logger != nil {
+		return logger
+	}
+	if l := d.Opts().Logger; l != nil {
+		return badgerLogger{l: l}
+	}
+	return nopLogger{}
+}
+
+// nopLogger is a DiagLogger that discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string)            {}
+func (nopLogger) Info(msg string)             {}
+func (nopLogger) Error(err error, msg string) {}
+
+// badgerLogger adapts a badger.Logger to DiagLogger.
+type badgerLogger struct {
+	l badger.Logger
+}
+
+func (b badgerLogger) Debug(msg string) {
+	b.l.Debugf("%s", msg)
+}
+
+func (b badgerLogger) Info(msg string) {
+	b.l.Infof("%s", msg)
+}
+
+func (b badgerLogger) Error(err error, msg string) {
+	b.l.Errorf("%s: %v", msg, err)
+}
+
+// stdLogger adapts a standard library *log.Logger to badger.Logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a badger.Logger, for Options.Logger, that writes
+// badger's diagnostics and background GC failures to l, each prefixed with
+// its level. A nil l uses the standard logger of the log package.
+func NewStdLogger(l *log.Logger) badger.Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l}
+}
+
+func (s stdLogger) logf(level, format string, args ...interface{}) {
+	s.l.Output(3, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (s stdLogger) Errorf(format string, args ...interface{}) {
+	s.logf("ERROR:", format, args...)
+}
+
+func (s stdLogger) Warningf(format string, args ...interface{}) {
+	s.logf("WARNING:", format, args...)
+}
+
+func (s stdLogger) Infof(format string, args ...interface{}) {
+	s.logf("INFO:", format, args...)
+}
+
+func (s stdLogger) Debugf(format string, args ...interface{}) {
+	s.logf("DEBUG:", format, args...)
+}
@@ -0,0 +1,117 @@
+package mstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// mergeOps holds every badger merge operator started since the store was
+// opened. Each runs a goroutine until it is stopped by Close.
+var (
+	mergeMu  sync.Mutex
+	mergeOps []*badger.MergeOperator
+)
+
+// stopMergeOperators stops every merge operator, writing out their pending
+// merges. The lock must be held for writing.
+func stopMergeOperators() {
+	mergeMu.Lock()
+	defer mergeMu.Unlock()
+
+	for _, op := range mergeOps {
+		op.Stop()
+	}
+	mergeOps = nil
+}
+
+// MergeOperator accumulates values added under one key with a merge
+// function, without read-modify-write transactions. Adds never conflict
+// with each other; the merge function is applied when the value is read and
+// periodically in the background to fold the added values together.
+type MergeOperator struct {
+	db *badger.DB
+	op *badger.MergeOperator
+}
+
+// NewMergeOperator returns a MergeOperator for key. f combines the value
+// accumulated so far with a newly added one and must be commutative and
+// associative, as values may be folded in any grouping. The added values are
+// folded into one stored value every interval, when the operator is stopped
+// and when the store is closed. The key should only be used through the
+// operator.
+func NewMergeOperator(key []byte, f func(existing, value []byte) []byte, interval time.Duration) (*MergeOperator, error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+	if f == nil {
+		return nil, errors.New("merge function must not be nil")
+	}
+	if interval <= 0 {
+		return nil, errors.New("interval must be greater than zero")
+	}
+
+	mergeMu.Lock()
+	defer mergeMu.Unlock()
+
+	op := db.GetMergeOperator(key, f, interval)
+	mergeOps = append(mergeOps, op)
+	return &MergeOperator{db: db, op: op}, nil
+}
+
+// use read-locks the store, failing when the store the operator was created
+// on is no longer open.
+func (m *MergeOperator) use() error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	if m.db != db {
+		mu.RUnlock()
+		return ErrNotOpen
+	}
+	return nil
+}
+
+// Add adds value to the key.
+func (m *MergeOperator) Add(value []byte) error {
+	if err := m.use(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return m.op.Add(value)
+}
+
+// Get returns the merge of all the values added to the key, or ErrNotFound
+// when none were.
+func (m *MergeOperator) Get() ([]byte, error) {
+	if err := m.use(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	v, err := m.op.Get()
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return v, nil
+}
+
+// Stop stops folding the added values in the background, folding them one
+// last time. The operator must not be used afterwards. Operators that are
+// not stopped are stopped by Close.
+func (m *MergeOperator) Stop() {
+	if err := m.use(); err != nil {
+		return
+	}
+	defer mu.RUnlock()
+
+	m.op.Stop()
+}
@@ -0,0 +1,208 @@
+package mstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Options configures the behavior of the store. The zero value matches the
+// behavior of InitPersistentMode and InitDisklessMode.
+type Options struct {
+	// Path is the directory of a persistent store. Empty uses
+	// STORAGE_PATH. It is ignored in diskless mode.
+	Path string
+
+	// IdempotentSet makes Set return the existing key, without an error,
+	// when the entity already exists with a byte-identical value. A
+	// different value stored under the same key is still an error.
+	IdempotentSet bool
+
+	// DedupWindow is the number of recently stored keys Set remembers in
+	// memory, with a fingerprint of their values and when they expire, so
+	// duplicates in a high-ingest stream are rejected without reading the
+	// database. Keys that are not in the window, or have expired, are fully
+	// checked against the database, so no duplicate is ever missed. With
+	// IdempotentSet the database is always consulted to compare values.
+	// Zero disables the window.
+	DedupWindow int
+
+	// TrackModTime stores the time each value is written alongside it so
+	// that ModifiedSince can yield the entries changed after a point in
+	// time. It adds 8 bytes to every stored value.
+	TrackModTime bool
+
+	// CompressValuesOver is the size in bytes above which SetValue gzips
+	// the marshaled value before storing it. Compression costs CPU on
+	// every read and write, so small values are left as they are. Zero
+	// disables compression.
+	CompressValuesOver int
+
+	// Compression compresses every stored value with the given algorithm,
+	// transparently to readers. It suits large, compressible values such as
+	// JSON documents, shrinking the value log at the cost of CPU on every
+	// read and write; values that do not shrink are stored as they are.
+	// Snappy is the faster of the two, zstd compresses better. Keys, and
+	// therefore deduplication, are derived from the uncompressed value.
+	Compression Compression
+
+	// TableCompression compresses the blocks of badger's on-disk tables,
+	// which hold the keys and the values small enough to be kept with them,
+	// reducing disk usage for compressible data. The zero value keeps
+	// badger's default, Snappy. TableCompressionLevel is the zstd level,
+	// from 1, the fastest, to 22; zero uses badger's default of 1. It
+	// requires TableCompressionZstd.
+	TableCompression      TableCompression
+	TableCompressionLevel int
+
+	// NumCompactors is the number of badger compaction workers. More
+	// workers keep up with write-heavy workloads at the cost of CPU, fewer
+	// suit constrained environments. Badger requires at least two; zero
+	// uses badger's default.
+	NumCompactors int
+
+	// SyncWrites makes every commit wait until it is synced to disk. By
+	// default writes are acknowledged once they reach the operating
+	// system, so a machine crash can lose the most recently committed
+	// writes; enabling it closes that window, but every commit then pays
+	// for an fsync, which can cut write throughput by an order of
+	// magnitude on slow disks. It has no effect in diskless mode.
+	SyncWrites bool
+
+	// ForbidNetworkFS refuses to open a persistent store on a network
+	// filesystem such as NFS or SMB, whose locking semantics can corrupt
+	// badger, returning ErrNetworkFS instead. Detection is only available
+	// on Linux.
+	ForbidNetworkFS bool
+
+	// WarmCache walks every key when the store is opened so badger's
+	// index and block caches are populated before the first request,
+	// trading a longer startup for faster first reads. Warming is best
+	// effort; failures are ignored.
+	WarmCache bool
+
+	// ReadOnly opens a persistent store, which must already exist, for
+	// reading only. See InitReadOnly. It cannot be used in diskless mode.
+	ReadOnly bool
+
+	// Logger receives badger's diagnostics and, unless SetLogger has set a
+	// DiagLogger, mstore's own, such as the failures of the background GC.
+	// NewStdLogger adapts a standard library logger. Nil keeps badger
+	// quiet.
+	Logger badger.Logger
+
+	// MaxEntries and MaxBytes bound the store, for use as a cache, by
+	// evicting the least recently written or read entries once it holds
+	// more than MaxEntries entries or more than MaxBytes bytes of keys and
+	// stored values. The limits are enforced every GC_INTERVAL by the
+	// background GC, and on demand by Evict, so the store can exceed them
+	// in between. Each sweep scans every key, without values, and sorts
+	// them, and every key read is remembered in memory with an 8 byte
+	// timestamp until it is evicted or found deleted by a sweep. Recency is
+	// not persisted for reads, so after a restart entries are ranked by
+	// when they were last written. A stream written by SetStream is
+	// evicted as a whole. Zero disables a limit.
+	MaxEntries int
+	MaxBytes   int64
+
+	// DefaultTTL is the time to live of every entry written without one, by
+	// Set and the other write functions, turning the store into a TTL cache.
+	// SetWithTTL, SetWithExpiry and UpdateTTL override it per entry. Zero
+	// means entries do not expire.
+	DefaultTTL time.Duration
+
+	// OnExpire is called with the key of every entry whose TTL lapses, so
+	// that expiry can have side effects such as notifying another system.
+	// A sweeper scans the keys every ExpirySweepInterval, one second when
+	// it is zero, and reports the entries that will expire before the next
+	// sweep, so OnExpire is typically called up to one interval before the
+	// entry expires. Entries whose whole TTL falls between two sweeps are
+	// reported at the next sweep, shortly after they expired. Each expiry
+	// is reported once, from a single goroutine, and only for entries that
+	// expire after the store was opened and have not been removed or
+	// overwritten without a TTL; an entry whose TTL is changed is reported
+	// again for its new expiry. Callbacks may still be running when Close
+	// returns.
+	OnExpire            func(key []byte)
+	ExpirySweepInterval time.Duration
+
+	// EncryptionKey enables AES encryption of the data at rest. It must be
+	// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256, and
+	// the same key must be supplied every time the store is opened.
+	EncryptionKey []byte
+}
+
+// encryptionIndexCacheSize is the index cache badger requires when
+// encryption is enabled.
+const encryptionIndexCacheSize = 100 << 20
+
+// options holds the Options the store was last initialized with.
+var options Options
+
+// badgerOptions applies o to the badger options the store is opened with.
+func (o Options) badgerOptions(opts badger.Options) (badger.Options, error) {
+	if o.NumCompactors < 0 || o.NumCompactors == 1 {
+		return opts, errors.New("NumCompactors must be at least 2")
+	}
+	if o.NumCompactors > 0 {
+		opts = opts.WithNumCompactors(o.NumCompactors)
+	}
+	if o.DefaultTTL < 0 {
+		return opts, errors.New("DefaultTTL cannot be negative")
+	}
+	if o.ExpirySweepInterval < 0 {
+		return opts, errors.New("ExpirySweepInterval cannot be negative")
+	}
+	if o.MaxEntries < 0 || o.MaxBytes < 0 {
+		return opts, errors.New("MaxEntries and MaxBytes cannot be negative")
+	}
+	if o.SyncWrites && !opts.InMemory {
+		opts = opts.WithSyncWrites(true)
+	}
+	if o.ReadOnly {
+		if opts.InMemory {
+			return opts, errors.New("ReadOnly requires a persistent store")
+		}
+		opts = opts.WithReadOnly(true)
+	}
+	if o.Compression > CompressionZstd {
+		return opts, fmt.Errorf("unknown compression %v", o.Compression)
+	}
+	if o.TableCompression != TableCompressionDefault {
+		c, err := o.TableCompression.badgerType()
+		if err != nil {
+			return opts, err
+		}
+		opts = opts.WithCompression(c)
+	}
+	if o.TableCompressionLevel != 0 {
+		if o.TableCompression != TableCompressionZstd {
+			return opts, errors.New("TableCompressionLevel requires TableCompressionZstd")
+		}
+		if o.TableCompressionLevel < 1 || o.TableCompressionLevel > 22 {
+			return opts, fmt.Errorf("TableCompressionLevel must be between 1 and 22, got %d", o.TableCompressionLevel)
+		}
+		opts = opts.WithZSTDCompressionLevel(o.TableCompressionLevel)
+	}
+	if len(o.EncryptionKey) > 0 {
+		if err := checkEncryptionKey(o.EncryptionKey); err != nil {
+			return opts, err
+		}
+		opts = opts.
+			WithEncryptionKey(o.EncryptionKey).
+			WithIndexCacheSize(encryptionIndexCacheSize)
+	}
+
+	return opts, nil
+}
+
+// checkEncryptionKey reports whether key has a length AES accepts.
+func checkEncryptionKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("EncryptionKey must be 16, 24 or 32 bytes, got %d", len(key))
+}
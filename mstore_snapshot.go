@@ -0,0 +1,122 @@
+package mstore
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ReadSnapshot is a read-only, point-in-time view of the store. Writes made
+// after it was taken are not visible through it. A snapshot pins the badger
+// tables it reads from, so holding one for a long time prevents their space
+// from being reclaimed; Close it as soon as it is no longer needed.
+type ReadSnapshot struct {
+	mu  sync.Mutex
+	db  *badger.DB
+	txn *badger.Txn
+}
+
+// Snapshot takes a ReadSnapshot of the store while writes continue.
+func Snapshot() (*ReadSnapshot, error) {
+	if err := rlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	return &ReadSnapshot{db: db, txn: db.NewTransaction(false)}, nil
+}
+
+// use locks the snapshot and the store for reading. It fails when the
+// snapshot was closed or the store it was taken from is no longer open.
+func (s *ReadSnapshot) use() error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.txn == nil || s.db != db {
+		s.mu.Unlock()
+		mu.RUnlock()
+		return errors.New("the snapshot is closed")
+	}
+	return nil
+}
+
+func (s *ReadSnapshot) release() {
+	s.mu.Unlock()
+	mu.RUnlock()
+}
+
+// Get retrieves the value of key as of the snapshot.
+func (s *ReadSnapshot) Get(key []byte) ([]byte, error) {
+	if err := s.use(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	item, err := s.txn.Get(key)
+	if err != nil {
+		return nil, missing(s.txn, key, err)
+	}
+	return itemValue(item)
+}
+
+// ForEach streams every entry of the snapshot to fn like the package level
+// ForEach.
+func (s *ReadSnapshot) ForEach(fn func(key, value []byte) error) error {
+	if err := s.use(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	it := s.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		v, err := itemValue(item)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), v); err != nil {
+			if err == ErrStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the number of entries in the snapshot.
+func (s *ReadSnapshot) Count() (n int, err error) {
+	if err := s.use(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := s.txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		n++
+	}
+	return n, nil
+}
+
+// Close releases the snapshot. It is safe to call more than once.
+func (s *ReadSnapshot) Close() {
+	mu.RLock()
+	defer mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.txn != nil && isOpen && s.db == db {
+		s.txn.Discard()
+	}
+	s.txn = nil
+}
@@ -0,0 +1,117 @@
+package mstore
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// StoreStats is a point in time view of the size and activity of the store,
+// suitable for exporting to a monitoring system.
+type StoreStats struct {
+	// LSMSize and VlogSize are the sizes in bytes of the LSM tree and the
+	// value log as last computed by badger. Badger refreshes them
+	// periodically, so they may lag behind recent writes.
+	LSMSize  int64
+	VlogSize int64
+
+	// NumEntries is the number of live entries in the store.
+	NumEntries int
+
+	// GCRuns is the number of value log GC passes and GCRewrites the number
+	// of value log files rewritten by them since the store was opened.
+	GCRuns     uint64
+	GCRewrites uint64
+
+	// Levels describes each level of the LSM tree, from level 0 down.
+	Levels []LevelStats
+}
+
+// LevelStats describes one level of the LSM tree.
+type LevelStats struct {
+	Level     int
+	NumTables int
+
+	// Size is the size in bytes of the tables in the level and TargetSize
+	// the size badger compacts the level towards.
+	Size       int64
+	TargetSize int64
+}
+
+// Size returns the size in bytes of the LSM tree and the value log on disk,
+// as last computed by badger. Both are zero in diskless mode.
+func Size() (lsm, vlog int64, err error) {
+	if err := rlock(); err != nil {
+		return 0, 0, err
+	}
+	defer mu.RUnlock()
+
+	if db.Opts().InMemory {
+		return 0, 0, nil
+	}
+	lsm, vlog = db.Size()
+	return lsm, vlog, nil
+}
+
+// Stats returns the current statistics of the store. Counting the entries
+// iterates over every key, so avoid calling it on a hot path.
+func Stats() (s StoreStats, err error) {
+	if err := rlock(); err != nil {
+		return s, err
+	}
+	defer mu.RUnlock()
+
+	s.LSMSize, s.VlogSize = db.Size()
+	if s.NumEntries, err = count(nil); err != nil {
+		return StoreStats{}, err
+	}
+	s.GCRuns = atomic.LoadUint64(&gcRuns)
+	s.GCRewrites = atomic.LoadUint64(&gcRewrites)
+	for _, l := range db.Levels() {
+		s.Levels = append(s.Levels, LevelStats{
+			Level:      l.Level,
+			NumTables:  l.NumTables,
+			Size:       l.Size,
+			TargetSize: l.TargetSize,
+		})
+	}
+	return s, nil
+}
+
+// opSets, opGets, opRemoves and opErrors count the calls to Set, Get and
+// Remove, and how many of them failed, since the process started. They are
+// never reset so they can be exported as monotonic counters.
+var (
+	opSets    uint64
+	opGets    uint64
+	opRemoves uint64
+	opErrors  uint64
+)
+
+// countOp records a call that incremented counter and finished with err.
+func countOp(counter *uint64, err error) {
+	atomic.AddUint64(counter, 1)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		atomic.AddUint64(&opErrors, 1)
+	}
+}
+
+// OpCounts is the number of calls made to Set, Get and Remove since the
+// process started. Errors counts the calls that failed; a Get of a missing
+// key is not counted as an error.
+type OpCounts struct {
+	Sets    uint64
+	Gets    uint64
+	Removes uint64
+	Errors  uint64
+}
+
+// Ops returns the operation counters. Unlike Stats it is cheap and works
+// whether or not the store is open.
+func Ops() OpCounts {
+	return OpCounts{
+		Sets:    atomic.LoadUint64(&opSets),
+		Gets:    atomic.LoadUint64(&opGets),
+		Removes: atomic.LoadUint64(&opRemoves),
+		Errors:  atomic.LoadUint64(&opErrors),
+	}
+}
@@ -0,0 +1,223 @@
+package mstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// StreamChunkSize is the size of the chunks SetStream splits a value into.
+// Only the last chunk of a stream may be shorter. It is kept below badger's
+// value threshold, which diskless mode cannot exceed.
+const StreamChunkSize = 512 << 10
+
+// maxStreamChunks bounds the number of chunks of a stream, as the chunk
+// index is written with eight decimal digits.
+const maxStreamChunks = 100000000
+
+// errNotStream is returned when a key read as a stream was not written by
+// SetStream.
+var errNotStream = errors.New("value was not stored by SetStream")
+
+// chunkKey returns the key of chunk i of the stream stored under key: the
+// key, a colon and i as eight decimal digits, e.g. "key:00000001".
+func chunkKey(key []byte, i uint64) []byte {
+	ck := make([]byte, 0, len(key)+9)
+	ck = append(ck, key...)
+	return append(ck, fmt.Sprintf(":%08d", i)...)
+}
+
+// streamChunks reads the number of chunks of the stream stored under key
+// from its manifest. A missing key is reported as badger.ErrKeyNotFound and
+// a key holding any other value as errNotStream.
+func streamChunks(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if item.UserMeta()&metaStream == 0 {
+		return 0, errNotStream
+	}
+	manifest, err := itemValue(item)
+	if err != nil {
+		return 0, err
+	}
+	if len(manifest) != 8 {
+		return 0, errors.New("stream manifest is corrupt")
+	}
+	n := binary.BigEndian.Uint64(manifest)
+	if n > maxStreamChunks {
+		return 0, errors.New("stream manifest is corrupt")
+	}
+	return n, nil
+}
+
+// SetStream stores everything read from r under key without holding it in
+// memory, for large values such as files. The value is split into chunks of
+// StreamChunkSize bytes stored under the key followed by a colon and the
+// chunk index as eight decimal digits, "<key>:00000000", "<key>:00000001"
+// and so on, while key itself holds a manifest with the number of chunks.
+// An existing stream under key is replaced, while a key holding any other
+// value is left as it is and an error is returned. The write is not atomic:
+// readers may see a mix of the old and new chunks while it is in progress,
+// and a failed SetStream can leave a replaced stream corrupt, so it should
+// be retried. Read the value back with GetStream and delete it with
+// RemoveStream. With Options.MaxEntries or Options.MaxBytes set, a stream is
+// evicted as a whole, counting each of its chunks as an entry.
+func SetStream(key []byte, r io.Reader) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	var old uint64
+	err := db.View(func(txn *badger.Txn) (err error) {
+		old, err = streamChunks(txn, key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	var n uint64
+	buf := make([]byte, StreamChunkSize)
+	for {
+		size, err := io.ReadFull(r, buf)
+		if size > 0 {
+			if n == maxStreamChunks {
+				return fmt.Errorf("stream is larger than %d chunks", maxStreamChunks)
+			}
+			chunk := append([]byte{}, buf[:size]...)
+			if err := wb.SetEntry(newEntry(chunkKey(key, n), chunk)); err != nil {
+				return err
+			}
+			n++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := n; i < old; i++ {
+		if err := wb.Delete(chunkKey(key, i)); err != nil {
+			return err
+		}
+	}
+
+	manifest := make([]byte, 8)
+	binary.BigEndian.PutUint64(manifest, n)
+	entry := newEntry(key, manifest)
+	entry.UserMeta |= metaStream
+	if err := wb.SetEntry(entry); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	window.remove(key)
+	return nil
+}
+
+// GetStream writes the value stored under key by SetStream to w, one chunk
+// at a time, within a single read transaction.
+func GetStream(key []byte, w io.Writer) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	return db.View(func(txn *badger.Txn) error {
+		n, err := streamChunks(txn, key)
+		if err == badger.ErrKeyNotFound {
+			return missing(txn, key, err)
+		}
+		if err != nil {
+			return err
+		}
+		lru.touch(key, txn.ReadTs())
+
+		for i := uint64(0); i < n; i++ {
+			item, err := txn.Get(chunkKey(key, i))
+			if err == badger.ErrKeyNotFound {
+				return fmt.Errorf("stream %s is missing chunk %d", KeyString(key), i)
+			}
+			if err != nil {
+				return err
+			}
+			chunk, err := itemValue(item)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveStream removes the value stored under key by SetStream along with
+// all of its chunks. Removing a key that does not exist is not an error,
+// while a key holding any other value is left as it is and an error is
+// returned.
+func RemoveStream(key []byte) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+
+	var n uint64
+	err := db.View(func(txn *badger.Txn) (err error) {
+		n, err = streamChunks(txn, key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for i := uint64(0); i < n; i++ {
+		if err := wb.Delete(chunkKey(key, i)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Delete(key); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	window.remove(key)
+	return nil
+}
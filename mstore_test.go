@@ -1,13 +1,26 @@
 package mstore_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
+	"log"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/MCGHealth/mstore"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -32,6 +45,67 @@ func TestGenPK(t *testing.T) {
 	assert.Nil(t, pk)
 }
 
+func TestKeyHash(t *testing.T) {
+	assert.Equal(t, md5.Size, mstore.KeyLen())
+	mstore.KeyHash = sha256.New
+	defer func() { mstore.KeyHash = md5.New }()
+	assert.Equal(t, sha256.Size, mstore.KeyLen())
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	assert.Len(t, key, mstore.KeyLen())
+
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = mstore.Get(make([]byte, md5.Size))
+	assert.EqualError(t, err, "key not found")
+}
+
+func TestKeyString(t *testing.T) {
+	key, err := mstore.GenPK([]byte("some data"))
+	require.NoError(t, err)
+
+	s := mstore.KeyString(key)
+	assert.Len(t, s, 2*len(key))
+
+	parsed, err := mstore.ParseKey(s)
+	assert.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	_, err = mstore.ParseKey("not hex")
+	assert.Error(t, err)
+}
+
+func TestSentinelErrors(t *testing.T) {
+	mstore.Close()
+	_, err := mstore.Get([]byte("key"))
+	assert.True(t, errors.Is(err, mstore.ErrNotOpen))
+	assert.True(t, errors.Is(err, mstore.ErrStoreClosed))
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	_, err = mstore.Get(nil)
+	assert.True(t, errors.Is(err, mstore.ErrInvalidKey))
+
+	_, err = mstore.Get([]byte("missing"))
+	assert.True(t, errors.Is(err, mstore.ErrNotFound))
+	assert.True(t, errors.Is(err, badger.ErrKeyNotFound))
+	assert.EqualError(t, err, "key not found")
+
+	data, _ := mstore.Marshal(testStruct())
+	_, err = mstore.Set(data)
+	require.NoError(t, err)
+	_, err = mstore.Set(data)
+	assert.True(t, errors.Is(err, mstore.ErrAlreadyExists))
+}
+
 func TestMarshalUnMarshal(t *testing.T) {
 	org := testStruct()
 	data, err := mstore.Marshal(org)
@@ -59,194 +133,2839 @@ func TestMarshalUnMarshal(t *testing.T) {
 
 }
 
-func TestStorage(t *testing.T) {
-	t.Run("Test Initialize", testInitPersistentMode) // <-- must run first
-	t.Run("Test Initialize while open", testInitWhileOpenReturnsError)
-	t.Run("Test Initialize Diskless Mode", testInitDisklessMode)
-	t.Run("Test Set and Get", testSetAndGet)
-	t.Run("Test Set with TTL", testSetWithTTL)
-	t.Run("Test Set Duplicate", testSetDupe)
-	t.Run("Test Set and Remove", testSetAndRemove)
-	t.Run("Test Get and Remove Batch", testGetAndRemoveBatch)
-	t.Run("Test invoking after closed db", testAfterClosed)
+type shape interface{ Area() float64 }
+
+type square struct{ Side float64 }
+
+func (s square) Area() float64 { return s.Side * s.Side }
+
+type drawing struct {
+	Name  string
+	Shape shape
 }
 
-func testInitPersistentMode(t *testing.T) {
-	mstore.InitPersistentMode()
-	assert.True(t, mstore.IsOpen())
-	assert.DirExists(t, mstore.STORAGE_PATH)
-	assert.True(t, mstore.IsOpen())
+func TestRegisterType(t *testing.T) {
+	mstore.RegisterType(square{})
 
-	err := mstore.Close()
-	assert.NoError(t, err)
-	assert.False(t, mstore.IsOpen())
+	org := drawing{Name: "box", Shape: square{Side: 2}}
+	data, err := mstore.Marshal(org)
+	require.NoError(t, err)
 
-	err = os.RemoveAll(mstore.STORAGE_PATH)
-	assert.NoError(t, err)
-	assert.NoDirExists(t, mstore.STORAGE_PATH)
+	var cpy drawing
+	require.NoError(t, mstore.Unmarshal(data, &cpy))
+	assert.Equal(t, org, cpy)
+	assert.Equal(t, 4.0, cpy.Shape.Area())
 }
 
-func testInitWhileOpenReturnsError(t *testing.T) {
-	err := mstore.InitPersistentMode()
-	assert.NoError(t, err)
+func TestMarshalNil(t *testing.T) {
+	_, err := mstore.Marshal(nil)
+	assert.EqualError(t, err, "cannot marshal nil value")
 
-	err = mstore.InitPersistentMode()
+	var obj *testObj
+	_, err = mstore.Marshal(obj)
+	assert.EqualError(t, err, "cannot marshal nil value")
+
+	type hidden struct{ n int }
+	_, err = mstore.Marshal(hidden{n: 1})
 	assert.Error(t, err)
+}
 
-	err = mstore.InitDisklessMode()
+func TestNumCompactors(t *testing.T) {
+	err := mstore.InitDisklessModeWithOptions(mstore.Options{NumCompactors: 1})
 	assert.Error(t, err)
+	assert.False(t, mstore.IsOpen())
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{NumCompactors: 2}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	d, ok := mstore.DB()
+	require.True(t, ok)
+	assert.Equal(t, 2, d.Opts().NumCompactors)
+
+	values := make([][]byte, 20000)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("burst-%d-%d", i, time.Now().UnixNano()))
+	}
+	_, errs := mstore.SetBatch(values)
+	require.Empty(t, errs)
+
+	l0 := d.Levels()[0]
+	assert.Less(t, l0.NumTables, d.Opts().NumLevelZeroTablesStall)
+}
+
+func TestConcurrentSetAndClose(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				data, _ := mstore.Marshal(testStruct())
+				if key, err := mstore.Set(data); err == nil {
+					mstore.Get(key)
+				}
+				mstore.IsOpen()
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, mstore.Close())
+		assert.NoError(t, mstore.InitDisklessMode())
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+
+	want := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		want[string(key)] = data
+	}
+
+	var buf bytes.Buffer
+	version, err := mstore.Backup(&buf, 0)
+	require.NoError(t, err)
+	assert.NotZero(t, version)
+
+	err = mstore.Restore(bytes.NewReader(buf.Bytes()))
+	assert.EqualError(t, err, "the storage is not empty")
+	assert.ErrorIs(t, err, mstore.ErrNotEmpty)
+
 	mstore.Close()
+	err = mstore.Restore(bytes.NewReader(buf.Bytes()))
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	require.NoError(t, mstore.Restore(&buf))
+	for k, v := range want {
+		got, err := mstore.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
 }
 
-func testInitDisklessMode(t *testing.T) {
+func TestIncrementalBackup(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+
+	data, _ := mstore.Marshal(testStruct())
+	first, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	var full bytes.Buffer
+	since, err := mstore.Backup(&full, 0)
+	require.NoError(t, err)
+
+	data, _ = mstore.Marshal(testStruct())
+	second, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	var incr bytes.Buffer
+	_, err = mstore.Backup(&incr, since)
+	require.NoError(t, err)
 	mstore.Close()
-	err := mstore.InitDisklessMode()
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	require.NoError(t, mstore.Restore(&incr))
+	_, err = mstore.Get(first)
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
+	got, err := mstore.Get(second)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = mstore.Backup(&incr, 0)
 	assert.NoError(t, err)
-	assert.True(t, mstore.IsOpen())
 }
 
-func testSetAndGet(t *testing.T) {
+func TestBackupNotOpen(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := mstore.Backup(&buf, 0)
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+}
+
+func TestRemoveValidatesKey(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	assert.ErrorIs(t, mstore.Remove(nil), mstore.ErrInvalidKey)
+	assert.ErrorIs(t, mstore.Remove([]byte{}), mstore.ErrInvalidKey)
+
+	// Keys of any other length are valid, as SetWithKey stores them.
+	for _, n := range []int{15, 17} {
+		key := bytes.Repeat([]byte{'k'}, n)
+		require.NoError(t, mstore.SetWithKey(key, []byte("value")))
+		assert.NoError(t, mstore.Remove(key))
+		_, err := mstore.Get(key)
+		assert.ErrorIs(t, err, mstore.ErrNotFound)
+	}
+}
+
+func TestDropAll(t *testing.T) {
+	assert.ErrorIs(t, mstore.DropAll(), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{DedupWindow: 10}))
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, mstore.SetWithKey([]byte(fmt.Sprintf("key-%d", i)), data))
+	}
+
+	assert.NoError(t, mstore.DropAll())
 	assert.True(t, mstore.IsOpen())
-	obj1 := testStruct()
-	data1, _ := mstore.Marshal(obj1)
-	key, err := mstore.Set(data1)
+	n, err := mstore.Count()
 	assert.NoError(t, err)
-	assert.Len(t, key, 16)
+	assert.Zero(t, n)
+	_, err = mstore.Get(key)
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
 
-	data2, err := mstore.Get(key)
+	_, err = mstore.Set(data)
 	assert.NoError(t, err)
-	assert.NotEmpty(t, data2)
+}
 
-	var obj2 testObj
-	err = mstore.Unmarshal(data2, &obj2)
-	assert.NoError(t, err)
-	assert.NotNil(t, obj2)
-	assert.Equal(t, obj1, obj2)
+func TestPop(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
 
-	shortKey := make([]byte, 17)
-	longKey := make([]byte, 15)
-	noValue := make([]byte, 16)
+	_, err := mstore.Pop([]byte("missing"))
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
 
-	data3, err := mstore.Get(shortKey)
-	assert.Error(t, err)
-	assert.Nil(t, data3)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("job/%d", i))
+		require.NoError(t, mstore.SetWithKey(key, []byte("payload")))
 
-	data4, err := mstore.Get(longKey)
-	assert.Error(t, err)
-	assert.Nil(t, data4)
+		var wg sync.WaitGroup
+		var popped, missed int32
+		for g := 0; g < 2; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := mstore.Pop(key)
+				switch {
+				case err == nil:
+					assert.Equal(t, []byte("payload"), value)
+					atomic.AddInt32(&popped, 1)
+				case errors.Is(err, mstore.ErrNotFound):
+					atomic.AddInt32(&missed, 1)
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, popped)
+		assert.EqualValues(t, 1, missed)
 
-	data5, err := mstore.Get(noValue)
-	assert.Error(t, err)
-	assert.Nil(t, data5)
+		_, err := mstore.Get(key)
+		assert.ErrorIs(t, err, mstore.ErrNotFound)
+	}
 }
 
-func testSetWithTTL(t *testing.T) {
-	assert.True(t, mstore.IsOpen())
-	oneSecond := 1 * time.Second
-	obj1 := testStruct()
-	data1, _ := mstore.Marshal(obj1)
-	key, err := mstore.SetWithTTL(data1, 1*oneSecond)
-	require.NoError(t, err)
-	require.Len(t, key, 16)
+func TestCompareAndSwap(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{TrackModTime: true}))
+	defer mstore.Close()
 
-	// give time for the entry to expire
-	time.Sleep(1100 * time.Millisecond)
+	key := []byte("counter")
+	swapped, err := mstore.CompareAndSwap(key, []byte("0"), []byte("1"))
+	assert.NoError(t, err)
+	assert.False(t, swapped, "a missing key must not match a non-nil old value")
 
-	_, err = mstore.Get(key)
-	require.Error(t, err)
+	swapped, err = mstore.CompareAndSwap(key, nil, []byte("0"))
+	assert.NoError(t, err)
+	assert.True(t, swapped)
 
-	obj2 := testStruct()
-	data2, _ := mstore.Marshal(obj2)
-	key2, err := mstore.SetWithTTL(data2, 1*time.Minute)
-	require.NoError(t, err)
-	require.Len(t, key2, 16)
+	swapped, err = mstore.CompareAndSwap(key, nil, []byte("0"))
+	assert.NoError(t, err)
+	assert.False(t, swapped)
 
-	data3, err := mstore.Get(key2)
-	require.NoError(t, err)
-	require.NotEmpty(t,data3)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; {
+				current, err := mstore.Get(key)
+				if !assert.NoError(t, err) {
+					return
+				}
+				var n int
+				fmt.Sscan(string(current), &n)
+				swapped, err := mstore.CompareAndSwap(key, current, []byte(fmt.Sprint(n+1)))
+				if errors.Is(err, badger.ErrConflict) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				if swapped {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("100"), got)
+
+	_, err = mstore.CompareAndSwap(nil, nil, []byte("x"))
+	assert.ErrorIs(t, err, mstore.ErrInvalidKey)
 }
 
-func testSetDupe(t *testing.T) {
-	org := testStruct()
-	data, _ := mstore.Marshal(org)
-	k1, err := mstore.Set(data)
+func TestUpdate(t *testing.T) {
+	assert.ErrorIs(t, mstore.Update(func(tx *mstore.Txn) error { return nil }), mstore.ErrNotOpen)
 
-	assert.NotEmpty(t, k1)
-	assert.Len(t, k1, 16)
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{TrackModTime: true}))
+	defer mstore.Close()
+
+	require.NoError(t, mstore.SetWithKey([]byte("from"), []byte("10")))
+
+	err := mstore.Update(func(tx *mstore.Txn) error {
+		v, err := tx.Get([]byte("from"))
+		if err != nil {
+			return err
+		}
+		if err := tx.Set([]byte("to"), v); err != nil {
+			return err
+		}
+		return tx.Delete([]byte("from"))
+	})
 	assert.NoError(t, err)
 
-	k2, err := mstore.Set(data)
-	assert.NotEqual(t, k1, k2)
-	assert.Error(t, err)
+	// A failing function leaves the store untouched.
+	failed := errors.New("failed")
+	err = mstore.Update(func(tx *mstore.Txn) error {
+		if err := tx.Set([]byte("other"), []byte("1")); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+
+	err = mstore.ViewTxn(func(tx *mstore.Txn) error {
+		ok, err := tx.Has([]byte("from"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		ok, err = tx.Has([]byte("other"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		v, err := tx.Get([]byte("to"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("10"), v)
+
+		_, err = tx.Get([]byte("missing"))
+		assert.ErrorIs(t, err, mstore.ErrNotFound)
+
+		assert.Error(t, tx.Set([]byte("x"), []byte("y")))
+		return nil
+	})
+	assert.NoError(t, err)
 }
 
-func testSetAndRemove(t *testing.T) {
-	org := testStruct()
-	data, _ := mstore.Marshal(org)
-	key, err := mstore.Set(data)
+func TestIncrement(t *testing.T) {
+	_, err := mstore.Increment([]byte("hits"), 1)
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	key := []byte("hits")
+	n, err := mstore.Counter(key)
 	assert.NoError(t, err)
+	assert.Zero(t, n)
 
-	obj, err := mstore.Get(key)
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := mstore.Increment(key, 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err = mstore.Increment(key, -100)
 	assert.NoError(t, err)
-	assert.NotNil(t, obj)
+	assert.EqualValues(t, 400, n)
 
-	err = mstore.Remove(key)
+	// The value survives a restart.
+	require.NoError(t, mstore.Close())
+	require.NoError(t, mstore.InitPersistentMode())
+	n, err = mstore.Counter(key)
 	assert.NoError(t, err)
+	assert.EqualValues(t, 400, n)
 
-	obj, err = mstore.Get(key)
-	assert.Errorf(t, err, "key not found")
-	assert.Nil(t, obj, "expected obj to be nil")
-}
+	// The counter is stored as a single big-endian int64.
+	d, _ := mstore.DB()
+	require.NoError(t, d.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		raw, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 1, 0x90}, raw)
+		return nil
+	}))
 
-func testGetAndRemoveBatch(t *testing.T) {
-	mstore.Close()
-	mstore.InitDisklessMode()
+	n, err = mstore.Increment([]byte("new"), 5)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+	n, err = mstore.Increment([]byte("new"), -7)
+	assert.NoError(t, err)
+	assert.EqualValues(t, -2, n)
 
-	for i := 0; i < 5; i++ {
-		org := testStruct()
-		data, _ := mstore.Marshal(org)
-		_, err := mstore.Set(data)
-		assert.NoError(t, err)
+	require.NoError(t, mstore.SetWithKey([]byte("text"), []byte("not a counter")))
+	_, err = mstore.Counter([]byte("text"))
+	assert.Error(t, err)
+
+	// values of any other length are refused rather than summed
+	for _, v := range []string{"abc", "not a counter"} {
+		k := []byte("text:" + v)
+		require.NoError(t, mstore.SetWithKey(k, []byte(v)))
+		_, err = mstore.Increment(k, 1)
+		assert.Error(t, err)
+		got, err := mstore.Get(k)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(v), got)
 	}
 
-	// testing GetBatch()
-	entries, err := mstore.GetBatch()
+	// counters cost no goroutines, however many are used
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("page:%d", i))
+		_, err := mstore.Increment(k, 1)
+		require.NoError(t, err)
+		_, err = mstore.Counter(k)
+		require.NoError(t, err)
+	}
+	assert.Less(t, runtime.NumGoroutine(), before+10)
+}
+
+func TestGetBatchPartial(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	good, err := mstore.Set([]byte("good"))
+	require.NoError(t, err)
+
+	// A value flagged as compressed with an unknown algorithm cannot be read.
+	d, _ := mstore.DB()
+	bad := []byte("bad")
+	require.NoError(t, d.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(bad, []byte{0xff, 1, 2, 3}).WithMeta(1 << 5))
+	}))
+
+	batch, err := mstore.GetBatch()
+	var berr *mstore.BatchError
+	require.True(t, errors.As(err, &berr))
+	assert.Len(t, berr.Errs, 1)
+	assert.Contains(t, berr.Errs, base64.StdEncoding.EncodeToString(bad))
+	assert.True(t, strings.HasPrefix(berr.Error(), mstore.KeyString(bad)+": "), berr.Error())
+	assert.Equal(t, map[string][]byte{base64.StdEncoding.EncodeToString(good): []byte("good")}, batch)
+}
+
+func TestEntries(t *testing.T) {
+	_, err := mstore.Entries()
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	entries, err := mstore.Entries()
 	assert.NoError(t, err)
-	assert.Len(t, entries, 5, "expected batch size to be 5")
+	assert.Empty(t, entries)
 
-	keys := make([][]byte, len(entries))
-	for k := range entries {
-		if len(k) == 0 {
-			continue
+	want := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		want[string(key)] = data
+	}
+
+	entries, err = mstore.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, len(want))
+	for i, e := range entries {
+		assert.Equal(t, want[string(e.Key)], e.Value)
+		if i > 0 {
+			assert.Equal(t, -1, bytes.Compare(entries[i-1].Key, e.Key))
 		}
-		key, err := base64.StdEncoding.DecodeString(k)
+		got, err := mstore.Get(e.Key)
 		assert.NoError(t, err)
-		if len(key) == 0 {
-			continue
-		}
-		keys = append(keys, key)
+		assert.Equal(t, e.Value, got)
 	}
 
-	ok, errs := mstore.RemoveBatch(keys)
-	assert.True(t, ok)
-	assert.Empty(t, errs)
+	require.NoError(t, mstore.Remove(entries[0].Key))
+	_, err = mstore.Get(entries[0].Key)
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
 }
 
-func testAfterClosed(t *testing.T) {
-	mstore.Close()
+func TestListAndRemoveEntries(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
 
-	s, err := mstore.Set(make([]byte, 16))
-	assert.Errorf(t, err, "the storage is not open")
-	assert.Nil(t, s)
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, mstore.SetWithKey([]byte(k), []byte("value of "+k)))
+	}
 
-	b, err := mstore.GetBatch()
-	assert.Errorf(t, err, "the storage is not open")
+	entries, err := mstore.List()
+	require.NoError(t, err)
+	assert.Equal(t, []mstore.Entry{
+		{Key: []byte("a"), Value: []byte("value of a")},
+		{Key: []byte("b"), Value: []byte("value of b")},
+		{Key: []byte("c"), Value: []byte("value of c")},
+	}, entries)
+
+	ok, errs := mstore.RemoveEntries(entries[:2])
+	assert.True(t, ok)
+	assert.Empty(t, errs)
+
+	entries, err = mstore.List()
+	require.NoError(t, err)
+	assert.Equal(t, []mstore.Entry{{Key: []byte("c"), Value: []byte("value of c")}}, entries)
+}
+
+func TestMergeOperator(t *testing.T) {
+	max := func(existing, value []byte) []byte {
+		if bytes.Compare(existing, value) > 0 {
+			return existing
+		}
+		return value
+	}
+
+	_, err := mstore.NewMergeOperator([]byte("max"), max, time.Second)
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	_, err = mstore.NewMergeOperator(nil, max, time.Second)
+	assert.ErrorIs(t, err, mstore.ErrInvalidKey)
+	_, err = mstore.NewMergeOperator([]byte("max"), nil, time.Second)
+	assert.Error(t, err)
+
+	op, err := mstore.NewMergeOperator([]byte("max"), max, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	_, err = op.Get()
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, op.Add([]byte(fmt.Sprintf("%03d", i))))
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := op.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("049"), got)
+
+	// The value is folded in the background without changing the result.
+	time.Sleep(50 * time.Millisecond)
+	got, err = op.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("049"), got)
+
+	op.Stop()
+	require.NoError(t, mstore.Close())
+	assert.ErrorIs(t, op.Add([]byte("100")), mstore.ErrNotOpen)
+}
+
+func TestDropPrefix(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	for _, k := range []string{"a/1", "a/2", "b/1", "c/1"} {
+		require.NoError(t, mstore.SetWithKey([]byte(k), []byte(k)))
+	}
+
+	assert.NoError(t, mstore.DropPrefix([]byte("a/"), []byte("b/")))
+	assert.NoError(t, mstore.DropPrefix([]byte("missing/")))
+	assert.NoError(t, mstore.DropPrefix())
+	assert.EqualError(t, mstore.DropPrefix([]byte("c/"), nil), "invalid prefix")
+
+	keys, err := mstore.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c/1")}, keys)
+}
+
+func TestDropPrefixTenant(t *testing.T) {
+	assert.ErrorIs(t, mstore.DropPrefix([]byte("tenant-1/")), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	for _, tenant := range []string{"tenant-1/", "tenant-10/", "tenant-2/"} {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, mstore.SetWithKey([]byte(fmt.Sprintf("%s%d", tenant, i)), []byte(tenant)))
+		}
+	}
+
+	require.NoError(t, mstore.DropPrefix([]byte("tenant-1/")))
+
+	for tenant, want := range map[string]int{"tenant-1/": 0, "tenant-10/": 10, "tenant-2/": 10} {
+		n, err := mstore.CountPrefix([]byte(tenant))
+		assert.NoError(t, err)
+		assert.Equal(t, want, n, tenant)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{TrackModTime: true}))
+	defer mstore.Close()
+
+	type event struct{ key, value []byte }
+	events := make(chan event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- mstore.Watch(ctx, []byte("user/"), func(key, value []byte) {
+			events <- event{key, value}
+		})
+	}()
+	// Give the subscription time to register before writing.
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, mstore.SetWithKey([]byte("order/1"), []byte("ignored")))
+	require.NoError(t, mstore.SetWithKey([]byte("user/1"), []byte("alice")))
+	require.NoError(t, mstore.Remove([]byte("user/1")))
+
+	for _, want := range []event{{[]byte("user/1"), []byte("alice")}, {[]byte("user/1"), nil}} {
+		select {
+		case got := <-events:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a watch event")
+		}
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	go func() {
+		done <- mstore.Watch(context.Background(), nil, func(key, value []byte) {})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, mstore.Close())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after Close")
+	}
+
+	assert.ErrorIs(t, mstore.Watch(context.Background(), nil, func(key, value []byte) {}), mstore.ErrNotOpen)
+
+	// Close may run before the subscription is made
+	for i := 0; i < 50; i++ {
+		require.NoError(t, mstore.InitDisklessMode())
+		go func() {
+			done <- mstore.Watch(context.Background(), nil, func(key, value []byte) {})
+		}()
+		require.NoError(t, mstore.Close())
+		select {
+		case err := <-done:
+			if err != nil {
+				assert.ErrorIs(t, err, mstore.ErrNotOpen)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Watch did not return after Close")
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	_, _, err := mstore.Size()
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	lsm, vlog, err := mstore.Size()
+	assert.NoError(t, err)
+	assert.Zero(t, lsm)
+	assert.Zero(t, vlog)
+	mstore.Close()
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	d, _ := mstore.DB()
+	wantLSM, wantVlog := d.Size()
+	lsm, vlog, err = mstore.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, wantLSM, lsm)
+	assert.Equal(t, wantVlog, vlog)
+}
+
+func TestRunGC(t *testing.T) {
+	assert.ErrorIs(t, mstore.RunGC(0.5), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	for _, ratio := range []float64{0, 1, -0.5, 1.5} {
+		assert.Error(t, mstore.RunGC(ratio))
+	}
+	assert.ErrorIs(t, mstore.RunGC(0.5), mstore.ErrNoGarbage)
+
+	mstore.Close()
+	require.NoError(t, mstore.InitDisklessMode())
+	assert.ErrorIs(t, mstore.RunGC(0.5), mstore.ErrNoGarbage)
+}
+
+func TestWatchPrefixes(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	keys := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mstore.WatchPrefixes(ctx, [][]byte{[]byte("a/"), []byte("a/b"), []byte("b/")}, func(key, value []byte) {
+		keys <- string(key)
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	for _, k := range []string{"a/b1", "c/1", "b/1"} {
+		require.NoError(t, mstore.SetWithKey([]byte(k), []byte(k)))
+	}
+
+	for _, want := range []string{"a/b1", "b/1"} {
+		select {
+		case got := <-keys:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a watch event")
+		}
+	}
+	select {
+	case got := <-keys:
+		t.Errorf("unexpected event for %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRunGCWithRatio(t *testing.T) {
+	assert.ErrorIs(t, mstore.RunGCWithRatio(0.5), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	assert.NoError(t, mstore.RunGCWithRatio(0.5))
+	mstore.Close()
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	assert.Error(t, mstore.RunGCWithRatio(0))
+	assert.Error(t, mstore.RunGCWithRatio(1))
+
+	values := make([][]byte, 100)
+	for i := range values {
+		values[i] = bytes.Repeat([]byte{byte(i)}, 1<<10)
+	}
+	keys, errs := mstore.SetBatch(values)
+	require.Empty(t, errs)
+	ok, _ := mstore.RemoveBatch(keys)
+	require.True(t, ok)
+
+	assert.NoError(t, mstore.RunGCWithRatio(0.5))
+	s, err := mstore.Stats()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, s.GCRuns)
+}
+
+func TestCompact(t *testing.T) {
+	assert.ErrorIs(t, mstore.Compact(1), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	values := make([][]byte, 1000)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("compact-%d", i))
+	}
+	_, errs := mstore.SetBatch(values)
+	require.Empty(t, errs)
+
+	assert.Error(t, mstore.Compact(0))
+	assert.NoError(t, mstore.Compact(2))
+	assert.NoError(t, mstore.Flatten(2))
+
+	n, err := mstore.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, len(values), n)
+	mstore.Close()
+
+	require.NoError(t, mstore.InitDisklessMode())
+	assert.EqualError(t, mstore.Flatten(2), "compaction is not supported in diskless mode")
+}
+
+func TestStats(t *testing.T) {
+	_, err := mstore.Stats()
+	assert.ErrorIs(t, err, mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	for i := 0; i < 3; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		_, err := mstore.Set(data)
+		require.NoError(t, err)
+	}
+	_, err = mstore.PurgePrefix([]byte("none"))
+	require.NoError(t, err)
+
+	s, err := mstore.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.NumEntries)
+	assert.GreaterOrEqual(t, s.LSMSize, int64(0))
+	assert.GreaterOrEqual(t, s.VlogSize, int64(0))
+	assert.EqualValues(t, 1, s.GCRuns)
+
+	d, _ := mstore.DB()
+	require.Len(t, s.Levels, len(d.Levels()))
+	for i, l := range s.Levels {
+		assert.Equal(t, i, l.Level)
+	}
+}
+
+func TestReopenDoesNotLeakGoroutines(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	require.NoError(t, mstore.Close())
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, mstore.InitDisklessMode())
+		require.NoError(t, mstore.Close())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
+
+func TestSyncWrites(t *testing.T) {
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{SyncWrites: true}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	d, ok := mstore.DB()
+	require.True(t, ok)
+	assert.True(t, d.Opts().SyncWrites)
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	mstore.Close()
+	require.NoError(t, mstore.InitPersistentMode())
+	d, ok = mstore.DB()
+	require.True(t, ok)
+	assert.False(t, d.Opts().SyncWrites, "expected synchronous writes to be off by default")
+}
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{})   { l.logf(format, args...) }
+func (l *testLogger) Warningf(format string, args ...interface{}) { l.logf(format, args...) }
+func (l *testLogger) Infof(format string, args ...interface{})    { l.logf(format, args...) }
+func (l *testLogger) Debugf(format string, args ...interface{})   { l.logf(format, args...) }
+
+func TestLogger(t *testing.T) {
+	require.NoError(t, mstore.InitPersistentMode())
+	d, _ := mstore.DB()
+	assert.Nil(t, d.Opts().Logger, "badger must be quiet by default")
+	mstore.Close()
+	os.RemoveAll(mstore.STORAGE_PATH)
+
+	logger := &testLogger{}
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{Logger: logger}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	require.NoError(t, mstore.Close())
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	assert.NotEmpty(t, logger.lines)
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := mstore.NewStdLogger(log.New(&buf, "", 0))
+	logger.Warningf("disk %d%% full", 90)
+	assert.Equal(t, "WARNING: disk 90% full\n", buf.String())
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{Logger: logger}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	require.NoError(t, mstore.Close())
+	assert.Contains(t, buf.String(), "INFO: ")
+}
+
+type recordingLogger struct {
+	testLogger
+}
+
+func (l *recordingLogger) Debug(msg string)            { l.logf("debug %s", msg) }
+func (l *recordingLogger) Info(msg string)             { l.logf("info %s", msg) }
+func (l *recordingLogger) Error(err error, msg string) { l.logf("error %s: %v", msg, err) }
+
+func TestSetLogger(t *testing.T) {
+	boom := errors.New("boom")
+
+	bl := &testLogger{}
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{Logger: bl}))
+	d, _ := mstore.DB()
+	mstore.LoggerFor(d).Error(boom, "gc failed")
+	bl.mu.Lock()
+	assert.Contains(t, bl.lines, "gc failed: boom")
+	bl.mu.Unlock()
+	mstore.Close()
+
+	l := &recordingLogger{}
+	mstore.SetLogger(l)
+	defer mstore.SetLogger(nil)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+	d, _ = mstore.DB()
+	mstore.LoggerFor(d).Error(boom, "gc failed")
+	mstore.LoggerFor(d).Info("evicted")
+	assert.Equal(t, []string{"error gc failed: boom", "info evicted"}, l.lines)
+
+	// without any logger messages are discarded
+	mstore.SetLogger(nil)
+	mstore.LoggerFor(d).Error(boom, "gc failed")
+	assert.Len(t, l.lines, 2)
+}
+
+func TestSync(t *testing.T) {
+	assert.ErrorIs(t, mstore.Sync(), mstore.ErrNotOpen)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	assert.NoError(t, mstore.Sync())
+	mstore.Close()
+
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	_, err := mstore.Set(data)
+	require.NoError(t, err)
+	assert.NoError(t, mstore.Sync())
+}
+
+func TestForbidNetworkFS(t *testing.T) {
+	restore := mstore.SetFSTypeProbe(func(string) (uint32, error) {
+		return 0x6969, nil // NFS
+	})
+	defer restore()
+
+	err := mstore.InitPersistentModeWithOptions(mstore.Options{ForbidNetworkFS: true})
+	assert.True(t, errors.Is(err, mstore.ErrNetworkFS))
+	assert.False(t, mstore.IsOpen())
+
+	// without the option the probe is not consulted
+	require.NoError(t, mstore.InitPersistentMode())
+	mstore.Close()
+	os.RemoveAll(mstore.STORAGE_PATH)
+	restore()
+
+	// the real probe accepts the local temporary directory
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{ForbidNetworkFS: true}))
+	mstore.Close()
+	os.RemoveAll(mstore.STORAGE_PATH)
+}
+
+func TestWarmCache(t *testing.T) {
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+
+	values := make([][]byte, 1000)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("warm-%d", i))
+	}
+	keys, err := mstore.BulkLoad(values)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Close())
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{WarmCache: true}))
+	defer mstore.Close()
+
+	for i, k := range keys {
+		got, err := mstore.Get(k)
+		require.NoError(t, err)
+		assert.Equal(t, values[i], got)
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{EncryptionKey: key}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+
+	data, _ := mstore.Marshal(testStruct())
+	k, err := mstore.Set(data)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Close())
+
+	err = mstore.InitPersistentModeWithOptions(mstore.Options{EncryptionKey: []byte("fedcba9876543210")})
+	assert.Error(t, err)
+	assert.False(t, mstore.IsOpen())
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{EncryptionKey: key}))
+	got, err := mstore.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.NoError(t, mstore.Close())
+
+	err = mstore.InitPersistentModeWithOptions(mstore.Options{EncryptionKey: []byte("short")})
+	assert.EqualError(t, err, "EncryptionKey must be 16, 24 or 32 bytes, got 5")
+}
+
+func TestInitPersistentModeEncrypted(t *testing.T) {
+	path, err := os.MkdirTemp("", "mstore-encrypted")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+
+	for _, n := range []int{0, 8, 31} {
+		err := mstore.InitPersistentModeEncrypted(path, make([]byte, n))
+		assert.EqualError(t, err, fmt.Sprintf("EncryptionKey must be 16, 24 or 32 bytes, got %d", n))
+		assert.False(t, mstore.IsOpen())
+	}
+
+	key := []byte("0123456789abcdef01234567")
+	require.NoError(t, mstore.InitPersistentModeEncrypted(path, key))
+	defer mstore.Close()
+
+	d, _ := mstore.DB()
+	assert.Equal(t, path, d.Opts().Dir)
+	assert.Equal(t, key, d.Opts().EncryptionKey)
+	assert.NotZero(t, d.Opts().IndexCacheSize)
+
+	data, _ := mstore.Marshal(testStruct())
+	k, err := mstore.Set(data)
+	require.NoError(t, err)
+	got, err := mstore.Get(k)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestInitReadOnly(t *testing.T) {
+	path, err := os.MkdirTemp("", "mstore-readonly")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+
+	assert.Error(t, mstore.InitReadOnly(path+"/missing"))
+	assert.EqualError(t, mstore.InitDisklessModeWithOptions(mstore.Options{ReadOnly: true}),
+		"ReadOnly requires a persistent store")
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{Path: path}))
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	_, err = mstore.Increment([]byte("hits"), 3)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Close())
+
+	require.NoError(t, mstore.InitReadOnly(path))
+	defer mstore.Close()
+
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	batch, err := mstore.GetBatch()
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	n, err := mstore.Counter([]byte("hits"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+
+	_, err = mstore.Set([]byte("more"))
+	assert.ErrorIs(t, err, mstore.ErrReadOnly)
+	_, err = mstore.SetWithTTL([]byte("more"), time.Minute)
+	assert.ErrorIs(t, err, mstore.ErrReadOnly)
+	assert.ErrorIs(t, mstore.Remove(key), mstore.ErrReadOnly)
+	assert.ErrorIs(t, mstore.DropAll(), mstore.ErrReadOnly)
+	assert.EqualError(t, mstore.DropPrefix([]byte("a")), "the storage is read-only")
+
+	_, errs := mstore.SetBatch([][]byte{[]byte("x"), []byte("y")})
+	assert.Equal(t, map[int]error{0: mstore.ErrReadOnly, 1: mstore.ErrReadOnly}, errs)
+	ok, rerrs := mstore.RemoveBatch([][]byte{key})
+	assert.False(t, ok)
+	assert.Equal(t, map[string]error{base64.StdEncoding.EncodeToString(key): mstore.ErrReadOnly}, rerrs)
+	assert.ErrorIs(t, mstore.Update(func(tx *mstore.Txn) error { return nil }), mstore.ErrReadOnly)
+	_, err = mstore.Pop(key)
+	assert.ErrorIs(t, err, mstore.ErrReadOnly)
+	assert.NoError(t, mstore.ViewTxn(func(tx *mstore.Txn) error {
+		ok, err := tx.Has(key)
+		assert.True(t, ok)
+		return err
+	}))
+
+	got, err = mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestJSONCodec(t *testing.T) {
+	mstore.SetCodec(mstore.JSONCodec{})
+	defer mstore.SetCodec(nil)
+
+	org := testStruct()
+	data, err := mstore.Marshal(org)
+	require.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"Nbr":%d,"Txt":%q}`, org.Nbr, org.Txt), string(data))
+
+	var cpy testObj
+	err = mstore.Unmarshal(data, &cpy)
+	assert.NoError(t, err)
+	assert.Equal(t, org, cpy)
+
+	err = mstore.Unmarshal([]byte("not json"), &cpy)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not unmarshal bytes")
+}
+
+func TestTableCompression(t *testing.T) {
+	for _, o := range []mstore.Options{
+		{TableCompressionLevel: 3},
+		{TableCompression: mstore.TableCompressionSnappy, TableCompressionLevel: 3},
+		{TableCompression: mstore.TableCompressionZstd, TableCompressionLevel: 23},
+		{TableCompression: mstore.TableCompression(9)},
+	} {
+		assert.Error(t, mstore.InitPersistentModeWithOptions(o), "%+v", o)
+	}
+
+	require.NoError(t, mstore.InitPersistentMode())
+	d, _ := mstore.DB()
+	assert.Equal(t, options.Snappy, d.Opts().Compression)
+	mstore.Close()
+	os.RemoveAll(mstore.STORAGE_PATH)
+
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{
+		TableCompression:      mstore.TableCompressionZstd,
+		TableCompressionLevel: 3,
+	}))
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	d, _ = mstore.DB()
+	assert.Equal(t, options.ZSTD, d.Opts().Compression)
+	assert.Equal(t, 3, d.Opts().ZSTDCompressionLevel)
+
+	data := bytes.Repeat([]byte(`{"event":"payload"}`), 100)
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Close())
+
+	// tables written with zstd are read back whatever the option
+	require.NoError(t, mstore.InitPersistentModeWithOptions(mstore.Options{
+		TableCompression: mstore.TableCompressionNone,
+	}))
+	defer mstore.Close()
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestCompression(t *testing.T) {
+	doc, _ := mstore.JSONCodec{}.Marshal(map[string]string{
+		"description": strings.Repeat("a large and very repetitive json document ", 200),
+	})
+
+	for _, c := range []mstore.Compression{mstore.CompressionSnappy, mstore.CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{Compression: c, TrackModTime: true}))
+			defer mstore.Close()
+
+			key, err := mstore.Set(doc)
+			require.NoError(t, err)
+			small, err := mstore.Set([]byte("tiny"))
+			require.NoError(t, err)
+
+			got, err := mstore.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, doc, got)
+
+			batch, err := mstore.GetBatch()
+			assert.NoError(t, err)
+			assert.Equal(t, doc, batch[base64.StdEncoding.EncodeToString(key)])
+
+			got, err = mstore.Get(small)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("tiny"), got)
+
+			d, _ := mstore.DB()
+			require.NoError(t, d.View(func(txn *badger.Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				assert.Less(t, item.ValueSize(), int64(len(doc)/4))
+				return nil
+			}))
+		})
+	}
+
+	err := mstore.InitDisklessModeWithOptions(mstore.Options{Compression: 42})
+	assert.EqualError(t, err, "unknown compression Compression(42)")
+}
+
+func TestCompressValuesOver(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{CompressValuesOver: 1024}))
+	defer mstore.Close()
+
+	large := testObj{Nbr: 1, Txt: strings.Repeat("compressible ", 1000)}
+	marshaled, _ := mstore.Marshal(large)
+	key, err := mstore.SetValue(large)
+	require.NoError(t, err)
+
+	want, _ := mstore.GenPK(marshaled)
+	assert.Equal(t, want, key)
+
+	stored, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Less(t, len(stored), len(marshaled))
+
+	var got testObj
+	require.NoError(t, mstore.GetValue(key, &got))
+	assert.Equal(t, large, got)
+
+	small := testStruct()
+	key, err = mstore.SetValue(small)
+	require.NoError(t, err)
+
+	marshaled, _ = mstore.Marshal(small)
+	stored, err = mstore.Get(key)
+	require.NoError(t, err)
+	assert.Len(t, stored, len(marshaled)+1)
+
+	var gotSmall testObj
+	require.NoError(t, mstore.GetValue(key, &gotSmall))
+	assert.Equal(t, small, gotSmall)
+}
+
+func TestStorage(t *testing.T) {
+	t.Run("Test Initialize", testInitPersistentMode) // <-- must run first
+	t.Run("Test Initialize while open", testInitWhileOpenReturnsError)
+	t.Run("Test Initialize Diskless Mode", testInitDisklessMode)
+	t.Run("Test Set and Get", testSetAndGet)
+	t.Run("Test Set with TTL", testSetWithTTL)
+	t.Run("Test Set with Expiry", testSetWithExpiry)
+	t.Run("Test Update TTL", testUpdateTTL)
+	t.Run("Test Update TTL extends expiry", testUpdateTTLExtends)
+	t.Run("Test Set with Key", testSetWithKey)
+	t.Run("Test Upsert", testUpsert)
+	t.Run("Test Set Duplicate", testSetDupe)
+	t.Run("Test Set Batch", testSetBatch)
+	t.Run("Test Set Batch with TTL", testSetBatchWithTTL)
+	t.Run("Test Bulk Load", testBulkLoad)
+	t.Run("Test Get or Compute", testGetOrCompute)
+	t.Run("Test Get or Set", testGetOrSet)
+	t.Run("Test Set and Remove", testSetAndRemove)
+	t.Run("Test Get Many", testGetMany)
+	t.Run("Test Get and Remove Batch", testGetAndRemoveBatch)
+	t.Run("Test Remove Batch is atomic", testRemoveBatchAtomic)
+	t.Run("Test Keys", testKeys)
+	t.Run("Test Count", testCount)
+	t.Run("Test Get Batch Page", testGetBatchPage)
+	t.Run("Test invoking after closed db", testAfterClosed)
+}
+
+func testInitPersistentMode(t *testing.T) {
+	mstore.InitPersistentMode()
+	assert.True(t, mstore.IsOpen())
+	assert.DirExists(t, mstore.STORAGE_PATH)
+	assert.True(t, mstore.IsOpen())
+
+	err := mstore.Close()
+	assert.NoError(t, err)
+	assert.False(t, mstore.IsOpen())
+
+	err = os.RemoveAll(mstore.STORAGE_PATH)
+	assert.NoError(t, err)
+	assert.NoDirExists(t, mstore.STORAGE_PATH)
+}
+
+func testInitWhileOpenReturnsError(t *testing.T) {
+	err := mstore.InitPersistentMode()
+	assert.NoError(t, err)
+
+	err = mstore.InitPersistentMode()
+	assert.Error(t, err)
+
+	err = mstore.InitDisklessMode()
+	assert.Error(t, err)
+	mstore.Close()
+}
+
+func testInitDisklessMode(t *testing.T) {
+	mstore.Close()
+	err := mstore.InitDisklessMode()
+	assert.NoError(t, err)
+	assert.True(t, mstore.IsOpen())
+}
+
+func testSetAndGet(t *testing.T) {
+	assert.True(t, mstore.IsOpen())
+	obj1 := testStruct()
+	data1, _ := mstore.Marshal(obj1)
+	key, err := mstore.Set(data1)
+	assert.NoError(t, err)
+	assert.Len(t, key, 16)
+
+	data2, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, data2)
+
+	var obj2 testObj
+	err = mstore.Unmarshal(data2, &obj2)
+	assert.NoError(t, err)
+	assert.NotNil(t, obj2)
+	assert.Equal(t, obj1, obj2)
+
+	shortKey := make([]byte, 17)
+	longKey := make([]byte, 15)
+	noValue := make([]byte, 16)
+
+	data3, err := mstore.Get(shortKey)
+	assert.Error(t, err)
+	assert.Nil(t, data3)
+
+	data4, err := mstore.Get(longKey)
+	assert.Error(t, err)
+	assert.Nil(t, data4)
+
+	data5, err := mstore.Get(noValue)
+	assert.Error(t, err)
+	assert.Nil(t, data5)
+
+	data6, err := mstore.Get([]byte{})
+	assert.EqualError(t, err, "invalid key")
+	assert.Nil(t, data6)
+}
+
+func testSetWithTTL(t *testing.T) {
+	assert.True(t, mstore.IsOpen())
+	oneSecond := 1 * time.Second
+	obj1 := testStruct()
+	data1, _ := mstore.Marshal(obj1)
+	key, err := mstore.SetWithTTL(data1, 1*oneSecond)
+	require.NoError(t, err)
+	require.Len(t, key, 16)
+
+	// give time for the entry to expire
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = mstore.Get(key)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, mstore.ErrExpired)
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
+
+	_, err = mstore.Get(make([]byte, 16))
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
+	assert.False(t, errors.Is(err, mstore.ErrExpired))
+
+	obj2 := testStruct()
+	data2, _ := mstore.Marshal(obj2)
+	key2, err := mstore.SetWithTTL(data2, 1*time.Minute)
+	require.NoError(t, err)
+	require.Len(t, key2, 16)
+
+	data3, err := mstore.Get(key2)
+	require.NoError(t, err)
+	require.NotEmpty(t,data3)
+}
+
+func testSetWithExpiry(t *testing.T) {
+	data, _ := mstore.Marshal(testStruct())
+	_, _, err := mstore.SetWithExpiry(data, time.Now().Add(-time.Second))
+	assert.Error(t, err)
+
+	want := time.Now().Add(1500 * time.Millisecond)
+	key, at, err := mstore.SetWithExpiry(data, want)
+	require.NoError(t, err)
+	assert.False(t, at.Before(want))
+	assert.True(t, at.Sub(want) < time.Second)
+
+	_, meta, err := mstore.GetWithMeta(key)
+	require.NoError(t, err)
+	assert.True(t, meta.ExpiresAt.Equal(at))
+
+	time.Sleep(time.Until(at) + 100*time.Millisecond)
+	_, err = mstore.Get(key)
+	assert.ErrorIs(t, err, mstore.ErrExpired)
+}
+
+func testUpdateTTL(t *testing.T) {
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	err = mstore.UpdateTTL(key, time.Second)
+	require.NoError(t, err)
+
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = mstore.Get(key)
+	assert.Error(t, err)
+
+	err = mstore.UpdateTTL(key, time.Second)
+	assert.EqualError(t, err, "key not found")
+
+	err = mstore.UpdateTTL(make([]byte, 16), 0)
+	assert.Error(t, err)
+}
+
+func testUpdateTTLExtends(t *testing.T) {
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.SetWithTTL(data, time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, mstore.UpdateTTL(key, time.Minute))
+
+	// sleep past the original expiry
+	time.Sleep(1500 * time.Millisecond)
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func testSetWithKey(t *testing.T) {
+	assert.True(t, mstore.IsOpen())
+	key := []byte(fmt.Sprintf("user:%d", time.Now().UnixNano()))
+	data, _ := mstore.Marshal(testStruct())
+
+	err := mstore.SetWithKey(key, data)
+	require.NoError(t, err)
+
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	err = mstore.SetWithKey(key, data)
+	assert.EqualError(t, err, "the entity already exists")
+
+	err = mstore.SetWithKey(nil, data)
+	assert.EqualError(t, err, "invalid key")
+}
+
+func testUpsert(t *testing.T) {
+	assert.True(t, mstore.IsOpen())
+	data1, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data1)
+	require.NoError(t, err)
+
+	data2, _ := mstore.Marshal(testStruct())
+	err = mstore.Upsert(key, data2)
+	require.NoError(t, err)
+
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data2, got)
+
+	err = mstore.Upsert(nil, data2)
+	assert.EqualError(t, err, "invalid key")
+}
+
+func testSetDupe(t *testing.T) {
+	org := testStruct()
+	data, _ := mstore.Marshal(org)
+	k1, err := mstore.Set(data)
+
+	assert.NotEmpty(t, k1)
+	assert.Len(t, k1, 16)
+	assert.NoError(t, err)
+
+	k2, err := mstore.Set(data)
+	assert.NotEqual(t, k1, k2)
+	assert.Error(t, err)
+}
+
+func testSetBatch(t *testing.T) {
+	existing, _ := mstore.Marshal(testStruct())
+	_, err := mstore.Set(existing)
+	require.NoError(t, err)
+
+	d1, _ := mstore.Marshal(testStruct())
+	d2, _ := mstore.Marshal(testStruct())
+	values := [][]byte{d1, existing, d2, d1, {}}
+
+	keys, errs := mstore.SetBatch(values)
+	require.Len(t, keys, len(values))
+	assert.Len(t, errs, 3)
+	assert.EqualError(t, errs[1], "the entity already exists")
+	assert.ErrorIs(t, errs[3], mstore.ErrAlreadyExists)
+	assert.Error(t, errs[4])
+
+	for _, i := range []int{0, 2} {
+		require.Len(t, keys[i], 16)
+		got, err := mstore.Get(keys[i])
+		assert.NoError(t, err)
+		assert.Equal(t, values[i], got)
+	}
+	for _, i := range []int{1, 3, 4} {
+		assert.Nil(t, keys[i])
+	}
+}
+
+func testSetBatchWithTTL(t *testing.T) {
+	d1, _ := mstore.Marshal(testStruct())
+	d2, _ := mstore.Marshal(testStruct())
+	values := [][]byte{d1, d2}
+
+	keys, errs := mstore.SetBatchWithTTL(values, 0)
+	assert.Nil(t, keys)
+	assert.Len(t, errs, 2)
+
+	before := time.Now()
+	keys, errs = mstore.SetBatchWithTTL(values, time.Minute)
+	require.Empty(t, errs)
+	for i, key := range keys {
+		got, meta, err := mstore.GetWithMeta(key)
+		require.NoError(t, err)
+		assert.Equal(t, values[i], got)
+		assert.WithinDuration(t, before.Add(time.Minute), meta.ExpiresAt, 2*time.Second)
+	}
+}
+
+func TestSetBatchWithTTLDedupWindow(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{DedupWindow: 10}))
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	keys, errs := mstore.SetBatchWithTTL([][]byte{data}, time.Second)
+	require.Empty(t, errs)
+
+	time.Sleep(2100 * time.Millisecond)
+	_, err := mstore.Get(keys[0])
+	require.ErrorIs(t, err, mstore.ErrExpired)
+
+	_, err = mstore.Set(data)
+	assert.NoError(t, err)
+}
+
+func testBulkLoad(t *testing.T) {
+	values := make([][]byte, 100)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("bulk-%d-%d", i, time.Now().UnixNano()))
+	}
+
+	keys, err := mstore.BulkLoad(values)
+	require.NoError(t, err)
+	require.Len(t, keys, len(values))
+	for i, k := range keys {
+		got, err := mstore.Get(k)
+		assert.NoError(t, err)
+		assert.Equal(t, values[i], got)
+	}
+
+	keys, err = mstore.BulkLoad([][]byte{[]byte("ok"), {}})
+	assert.Error(t, err)
+	assert.Nil(t, keys)
+}
+
+func testGetOrCompute(t *testing.T) {
+	key := []byte(fmt.Sprintf("computed:%d", time.Now().UnixNano()))
+	want, _ := mstore.Marshal(testStruct())
+
+	var runs int32
+	compute := func() ([]byte, error) {
+		atomic.AddInt32(&runs, 1)
+		time.Sleep(50 * time.Millisecond)
+		return want, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := mstore.GetOrCompute(key, time.Minute, compute)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = mstore.GetOrCompute(key, time.Minute, compute)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+
+	failing := []byte(fmt.Sprintf("failing:%d", time.Now().UnixNano()))
+	_, err = mstore.GetOrCompute(failing, 0, func() ([]byte, error) {
+		return nil, fmt.Errorf("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	_, err = mstore.Get(failing)
+	assert.Error(t, err)
+
+	// a panicking compute must not leave waiters or later callers blocked
+	panicking := []byte(fmt.Sprintf("panicking:%d", time.Now().UnixNano()))
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Panics(t, func() {
+			mstore.GetOrCompute(panicking, 0, func() ([]byte, error) {
+				close(started)
+				time.Sleep(50 * time.Millisecond)
+				panic("boom")
+			})
+		})
+	}()
+	<-started
+	_, err = mstore.GetOrCompute(panicking, 0, compute)
+	assert.EqualError(t, err, "compute function panicked")
+	<-done
+
+	got, err = mstore.GetOrCompute(panicking, 0, func() ([]byte, error) {
+		return want, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func testGetOrSet(t *testing.T) {
+	key := []byte(fmt.Sprintf("get-or-set:%d", time.Now().UnixNano()))
+	want := []byte("computed")
+
+	runs := 0
+	compute := func() ([]byte, error) {
+		runs++
+		return want, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := mstore.GetOrSet(key, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	assert.Equal(t, 1, runs)
+}
+
+func testSetAndRemove(t *testing.T) {
+	org := testStruct()
+	data, _ := mstore.Marshal(org)
+	key, err := mstore.Set(data)
+	assert.NoError(t, err)
+
+	obj, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.NotNil(t, obj)
+
+	err = mstore.Remove(key)
+	assert.NoError(t, err)
+
+	obj, err = mstore.Get(key)
+	assert.Errorf(t, err, "key not found")
+	assert.Nil(t, obj, "expected obj to be nil")
+}
+
+func testGetMany(t *testing.T) {
+	d1, _ := mstore.Marshal(testStruct())
+	d2, _ := mstore.Marshal(testStruct())
+	k1, err := mstore.Set(d1)
+	require.NoError(t, err)
+	k2, err := mstore.Set(d2)
+	require.NoError(t, err)
+	missing := make([]byte, 16)
+
+	entries, err := mstore.GetMany([][]byte{k1, missing, nil, k2, k1})
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, d1, entries[base64.StdEncoding.EncodeToString(k1)])
+	assert.Equal(t, d2, entries[base64.StdEncoding.EncodeToString(k2)])
+	assert.NotContains(t, entries, base64.StdEncoding.EncodeToString(missing))
+}
+
+func testGetAndRemoveBatch(t *testing.T) {
+	mstore.Close()
+	mstore.InitDisklessMode()
+
+	for i := 0; i < 5; i++ {
+		org := testStruct()
+		data, _ := mstore.Marshal(org)
+		_, err := mstore.Set(data)
+		assert.NoError(t, err)
+	}
+
+	// testing GetBatch()
+	entries, err := mstore.GetBatch()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5, "expected batch size to be 5")
+
+	keys := make([][]byte, len(entries))
+	for k := range entries {
+		if len(k) == 0 {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		assert.NoError(t, err)
+		if len(key) == 0 {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	ok, errs := mstore.RemoveBatch(keys)
+	assert.True(t, ok)
+	assert.Empty(t, errs)
+}
+
+func testRemoveBatchAtomic(t *testing.T) {
+	keys := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+
+	// badger refuses to delete keys in its internal namespace
+	bad := []byte("!badger!mstore")
+	ok, errs := mstore.RemoveBatch([][]byte{keys[0], bad, keys[1]})
+	assert.False(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs, base64.StdEncoding.EncodeToString(bad))
+
+	for _, k := range keys {
+		_, err := mstore.Get(k)
+		assert.NoError(t, err, "expected key to survive the failed batch")
+	}
+
+	ok, errs = mstore.RemoveBatch(keys)
+	assert.True(t, ok)
+	assert.Empty(t, errs)
+
+	for _, k := range keys {
+		_, err := mstore.Get(k)
+		assert.Error(t, err)
+	}
+}
+
+func testKeys(t *testing.T) {
+	mstore.Close()
+	mstore.InitDisklessMode()
+
+	keys, err := mstore.Keys()
+	assert.NoError(t, err)
+	assert.NotNil(t, keys)
+	assert.Empty(t, keys)
+
+	want := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		want[string(key)] = true
+	}
+
+	keys, err = mstore.Keys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, len(want))
+	for _, k := range keys {
+		assert.True(t, want[string(k)])
+	}
+
+	require.NoError(t, mstore.SetWithKey([]byte("prefixed:1"), []byte("v")))
+	require.NoError(t, mstore.SetWithKey([]byte("prefixed:2"), []byte("v")))
+	keys, err = mstore.KeysPrefix([]byte("prefixed:"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("prefixed:1"), []byte("prefixed:2")}, keys)
+}
+
+func testCount(t *testing.T) {
+	mstore.Close()
+	mstore.InitDisklessMode()
+
+	n, err := mstore.Count()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	data, _ := mstore.Marshal(testStruct())
+	require.NoError(t, mstore.SetWithKey([]byte("a:1"), data))
+	require.NoError(t, mstore.SetWithKey([]byte("a:2"), data))
+	require.NoError(t, mstore.SetWithKey([]byte("b:1"), data))
+
+	n, err = mstore.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = mstore.CountPrefix([]byte("a:"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func testGetBatchPage(t *testing.T) {
+	mstore.Close()
+	mstore.InitDisklessMode()
+
+	for i := 0; i < 7; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		_, err := mstore.Set(data)
+		require.NoError(t, err)
+	}
+
+	seen := make(map[string][]byte)
+	var cursor []byte
+	pages := 0
+	for {
+		page, next, err := mstore.GetBatchPage(cursor, 3)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page), 3)
+		for k, v := range page {
+			assert.NotContains(t, seen, k)
+			seen[k] = v
+		}
+		pages++
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 3, pages)
+
+	all, err := mstore.GetBatch()
+	require.NoError(t, err)
+	assert.Equal(t, all, seen)
+
+	paged := make(map[string][]byte)
+	cursor = nil
+	for {
+		page, next, err := mstore.GetBatchPaged(cursor, 5)
+		require.NoError(t, err)
+		for k, v := range page {
+			paged[k] = v
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, all, paged)
+
+	_, _, err = mstore.GetBatchPage(nil, 0)
+	assert.Error(t, err)
+}
+
+func TestDB(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+
+	d, ok := mstore.DB()
+	require.True(t, ok)
+	require.NotNil(t, d)
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	err = d.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+	assert.NoError(t, err)
+
+	mstore.Close()
+	d, ok = mstore.DB()
+	assert.False(t, ok)
+	assert.Nil(t, d)
+}
+
+func TestIdempotentSet(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{IdempotentSet: true}))
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	k1, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	k2, err := mstore.Set(data)
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2)
+
+	// plant a different value under the key the next Set will derive
+	other, _ := mstore.Marshal(testStruct())
+	key, err := mstore.GenPK(other)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Upsert(key, data))
+
+	k3, err := mstore.Set(other)
+	assert.ErrorIs(t, err, mstore.ErrKeyCollision)
+	assert.Nil(t, k3)
+
+	// a stored value is reported by SetBatch without being written again
+	ttl, _ := mstore.Marshal(testStruct())
+	k4, err := mstore.SetWithTTL(ttl, time.Hour)
+	require.NoError(t, err)
+	_, before, err := mstore.GetWithMeta(k4)
+	require.NoError(t, err)
+
+	keys, errs := mstore.SetBatch([][]byte{ttl})
+	assert.Empty(t, errs)
+	assert.Equal(t, [][]byte{k4}, keys)
+	_, after, err := mstore.GetWithMeta(k4)
+	require.NoError(t, err)
+	assert.Equal(t, before.ExpiresAt, after.ExpiresAt)
+	assert.Equal(t, before.Version, after.Version)
+}
+
+func TestKeyCollision(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	_, err := mstore.Set(data)
+	require.NoError(t, err)
+	_, err = mstore.Set(data)
+	assert.ErrorIs(t, err, mstore.ErrAlreadyExists)
+
+	// plant a different value under the key the next Set will derive
+	other, _ := mstore.Marshal(testStruct())
+	key, err := mstore.GenPK(other)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Upsert(key, data))
+
+	_, err = mstore.Set(other)
+	assert.ErrorIs(t, err, mstore.ErrKeyCollision)
+	assert.False(t, errors.Is(err, mstore.ErrAlreadyExists))
+
+	keys, errs := mstore.SetBatch([][]byte{data, other})
+	assert.Nil(t, keys[0])
+	assert.Nil(t, keys[1])
+	assert.ErrorIs(t, errs[0], mstore.ErrAlreadyExists)
+	assert.ErrorIs(t, errs[1], mstore.ErrKeyCollision)
+
+	got, err := mstore.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestMaxEntries(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{MaxEntries: 3}))
+	defer mstore.Close()
+
+	keys := make([][]byte, 5)
+	for i := range keys {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		keys[i] = key
+	}
+
+	// reading the oldest entry makes it the most recently used
+	_, err := mstore.Get(keys[0])
+	require.NoError(t, err)
+
+	n, err := mstore.Evict()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	count, err := mstore.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	for i, key := range keys {
+		_, err := mstore.Get(key)
+		if i == 1 || i == 2 {
+			assert.ErrorIs(t, err, mstore.ErrNotFound, "key %d", i)
+		} else {
+			assert.NoError(t, err, "key %d", i)
+		}
+	}
+
+	n, err = mstore.Evict()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestMaxBytes(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{MaxBytes: 1000}))
+	defer mstore.Close()
+
+	var last []byte
+	for i := 0; i < 10; i++ {
+		key, err := mstore.Set(bytes.Repeat([]byte{byte(i)}, 200))
+		require.NoError(t, err)
+		last = key
+	}
+
+	n, err := mstore.Evict()
+	require.NoError(t, err)
+	count, err := mstore.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 10, n+count)
+	assert.Less(t, count, 5)
+
+	_, err = mstore.Get(last)
+	assert.NoError(t, err)
+}
+
+func TestEvictionLimits(t *testing.T) {
+	err := mstore.InitDisklessModeWithOptions(mstore.Options{MaxEntries: -1})
+	assert.Error(t, err)
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	for i := 0; i < 3; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		_, err := mstore.Set(data)
+		require.NoError(t, err)
+	}
+	n, err := mstore.Evict()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestEvictStream(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{MaxEntries: 3}))
+	defer mstore.Close()
+
+	key := []byte("blob")
+	blob := make([]byte, 3*mstore.StreamChunkSize+100)
+	require.NoError(t, mstore.SetStream(key, bytes.NewReader(blob)))
+	require.NoError(t, mstore.SetWithKey([]byte("recent"), []byte("value")))
+
+	// the stream goes as a whole, leaving no orphaned chunks behind
+	n, err := mstore.Evict()
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	count, err := mstore.CountPrefix(key)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	_, err = mstore.Get([]byte("recent"))
+	assert.NoError(t, err)
+}
+
+func TestDedupWindow(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{DedupWindow: 2}))
+	defer mstore.Close()
+
+	values := make([][]byte, 5)
+	keys := make([][]byte, len(values))
+	for i := range values {
+		values[i], _ = mstore.Marshal(testStruct())
+		k, err := mstore.Set(values[i])
+		require.NoError(t, err)
+		keys[i] = k
+	}
+
+	// every value is rejected, including those that fell out of the window,
+	// which alone are read from the database
+	before := mstore.Lookups()
+	for i := len(values) - 1; i >= 0; i-- {
+		k, err := mstore.Set(values[i])
+		assert.EqualError(t, err, "the entity already exists")
+		assert.Nil(t, k)
+	}
+	assert.EqualValues(t, 3, mstore.Lookups()-before)
+
+	// removed keys are forgotten so they can be stored again
+	require.NoError(t, mstore.Remove(keys[4]))
+	_, err := mstore.Set(values[4])
+	assert.NoError(t, err)
+
+	ok, _ := mstore.RemoveBatch(keys[3:4])
+	require.True(t, ok)
+	_, err = mstore.Set(values[3])
+	assert.NoError(t, err)
+}
+
+// constHash derives the same key from every value, to provoke collisions.
+type constHash struct{ hash.Hash }
+
+func (constHash) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestDedupWindowCollisionsAndExpiry(t *testing.T) {
+	mstore.KeyHash = func() hash.Hash { return constHash{md5.New()} }
+	defer func() { mstore.KeyHash = md5.New }()
+
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{
+		DedupWindow: 10,
+		DefaultTTL:  time.Second,
+	}))
+	defer mstore.Close()
+
+	data := []byte("first")
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	_, err = mstore.Set(data)
+	assert.ErrorIs(t, err, mstore.ErrAlreadyExists)
+
+	// the key is in the window, but for another value
+	_, err = mstore.Set([]byte("second"))
+	assert.ErrorIs(t, err, mstore.ErrKeyCollision)
+
+	// once the entry expired the window no longer rejects it
+	time.Sleep(2100 * time.Millisecond)
+	_, err = mstore.Get(key)
+	require.ErrorIs(t, err, mstore.ErrExpired)
+	_, err = mstore.Set(data)
+	assert.NoError(t, err)
+	got, err := mstore.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestModifiedSince(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{TrackModTime: true}))
+	defer mstore.Close()
+
+	for i := 0; i < 2; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		_, err := mstore.Set(data)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	recent := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		recent[string(key)] = data
+
+		got, err := mstore.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	yielded := make(map[string][]byte)
+	err := mstore.ModifiedSince(since, func(key, value []byte) error {
+		yielded[string(key)] = value
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, recent, yielded)
+}
+
+func TestGetWithMeta(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	got, meta, err := mstore.GetWithMeta(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.True(t, meta.ExpiresAt.IsZero())
+	assert.True(t, meta.ModTime.IsZero())
+	assert.NotZero(t, meta.Version)
+
+	before := time.Now()
+	data2, _ := mstore.Marshal(testStruct())
+	key2, err := mstore.SetWithTTL(data2, time.Hour)
+	require.NoError(t, err)
+
+	got, meta2, err := mstore.GetWithMeta(key2)
+	require.NoError(t, err)
+	assert.Equal(t, data2, got)
+	assert.WithinDuration(t, before.Add(time.Hour), meta2.ExpiresAt, 2*time.Second)
+	assert.Greater(t, meta2.Version, meta.Version)
+
+	_, _, err = mstore.GetWithMeta(make([]byte, 16))
+	assert.EqualError(t, err, "key not found")
+}
+
+func TestDefaultTTL(t *testing.T) {
+	err := mstore.InitDisklessModeWithOptions(mstore.Options{DefaultTTL: -time.Second})
+	assert.Error(t, err)
+
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{DefaultTTL: time.Minute}))
+	defer mstore.Close()
+
+	before := time.Now()
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	_, meta, err := mstore.GetWithMeta(key)
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(time.Minute), meta.ExpiresAt, 2*time.Second)
+
+	data2, _ := mstore.Marshal(testStruct())
+	key2, err := mstore.SetWithTTL(data2, time.Hour)
+	require.NoError(t, err)
+	_, meta, err = mstore.GetWithMeta(key2)
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(time.Hour), meta.ExpiresAt, 2*time.Second)
+}
+
+func TestDefaultTTLWithDedupWindow(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{
+		DedupWindow: 10,
+		DefaultTTL:  time.Second,
+	}))
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.Set(data)
+	require.NoError(t, err)
+	batch, _ := mstore.Marshal(testStruct())
+	keys, errs := mstore.SetBatch([][]byte{batch})
+	require.Empty(t, errs)
+
+	time.Sleep(2100 * time.Millisecond)
+
+	// expired entries can be stored again to refill the cache
+	_, err = mstore.Set(data)
+	require.NoError(t, err)
+	_, errs = mstore.SetBatch([][]byte{batch})
+	require.Empty(t, errs)
+	for _, k := range [][]byte{key, keys[0]} {
+		_, err := mstore.Get(k)
+		assert.NoError(t, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	key := []byte("blob")
+	blob := make([]byte, 2*mstore.StreamChunkSize+100)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	require.NoError(t, mstore.SetStream(key, bytes.NewReader(blob)))
+
+	var buf bytes.Buffer
+	require.NoError(t, mstore.GetStream(key, &buf))
+	assert.Equal(t, blob, buf.Bytes())
+
+	// replacing with a shorter stream drops the extra chunks
+	short := []byte("short")
+	require.NoError(t, mstore.SetStream(key, bytes.NewReader(short)))
+	buf.Reset()
+	require.NoError(t, mstore.GetStream(key, &buf))
+	assert.Equal(t, short, buf.Bytes())
+	count, err := mstore.CountPrefix(key)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	require.NoError(t, mstore.SetStream([]byte("empty"), bytes.NewReader(nil)))
+	buf.Reset()
+	require.NoError(t, mstore.GetStream([]byte("empty"), &buf))
+	assert.Zero(t, buf.Len())
+
+	require.NoError(t, mstore.RemoveStream(key))
+	count, err = mstore.CountPrefix(key)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	err = mstore.GetStream(key, &buf)
+	assert.ErrorIs(t, err, mstore.ErrNotFound)
+	assert.ErrorIs(t, mstore.SetStream(nil, bytes.NewReader(blob)), mstore.ErrInvalidKey)
+}
+
+func TestStreamOverPlainValue(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	// 8 byte values must not be mistaken for stream manifests
+	plain := []byte("plain")
+	require.NoError(t, mstore.SetWithKey(plain, []byte("abcdefgh")))
+	counter := []byte("counter")
+	_, err := mstore.Increment(counter, 42)
+	require.NoError(t, err)
+
+	for _, key := range [][]byte{plain, counter} {
+		done := make(chan error, 1)
+		go func() { done <- mstore.SetStream(key, bytes.NewReader([]byte("stream"))) }()
+		select {
+		case err := <-done:
+			assert.Error(t, err, "%s", key)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("SetStream over %s did not return", key)
+		}
+
+		var buf bytes.Buffer
+		assert.Error(t, mstore.GetStream(key, &buf), "%s", key)
+		assert.Error(t, mstore.RemoveStream(key), "%s", key)
+	}
+
+	got, err := mstore.Get(plain)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abcdefgh"), got)
+	n, err := mstore.Counter(counter)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+}
+
+func TestOnExpire(t *testing.T) {
+	expired := make(chan []byte, 10)
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{
+		OnExpire:            func(key []byte) { expired <- key },
+		ExpirySweepInterval: 100 * time.Millisecond,
+	}))
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	key, err := mstore.SetWithTTL(data, 2*time.Second)
+	require.NoError(t, err)
+	_, err = mstore.SetWithTTL([]byte("removed"), time.Second)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Remove(mustKey(t, []byte("removed"))))
+	_, err = mstore.Set([]byte("forever"))
+	require.NoError(t, err)
+
+	select {
+	case got := <-expired:
+		assert.Equal(t, key, got)
+		// reported before the entry is gone
+		_, err := mstore.Get(key)
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnExpire was not called")
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	assert.Empty(t, expired)
+}
+
+func mustKey(t *testing.T, data []byte) []byte {
+	key, err := mstore.GenPK(data)
+	require.NoError(t, err)
+	return key
+}
+
+func TestPing(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	assert.NoError(t, mstore.Ping())
+
+	require.NoError(t, mstore.Close())
+	assert.ErrorIs(t, mstore.Ping(), mstore.ErrNotOpen)
+}
+
+func TestSetWithMeta(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessModeWithOptions(mstore.Options{
+		TrackModTime: true,
+		Compression:  mstore.CompressionSnappy,
+	}))
+	defer mstore.Close()
+
+	const tagJSON = 2
+	data := bytes.Repeat([]byte(`{"a":1}`), 64)
+	key, err := mstore.SetWithMeta(data, tagJSON)
+	require.NoError(t, err)
+
+	got, meta, err := mstore.GetWithMeta(key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, byte(tagJSON), meta.UserMeta)
+	assert.False(t, meta.ModTime.IsZero())
+
+	_, err = mstore.SetWithMeta(data, tagJSON)
+	assert.ErrorIs(t, err, mstore.ErrAlreadyExists)
+
+	_, err = mstore.SetWithMeta([]byte("other"), mstore.UserMetaMask+1)
+	assert.Error(t, err)
+
+	plain, _ := mstore.Marshal(testStruct())
+	key, err = mstore.Set(plain)
+	require.NoError(t, err)
+	_, meta, err = mstore.GetWithMeta(key)
+	require.NoError(t, err)
+	assert.Zero(t, meta.UserMeta)
+}
+
+func TestSnapshot(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	before := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		before[string(key)] = data
+	}
+
+	snap, err := mstore.Snapshot()
+	require.NoError(t, err)
+	defer snap.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	after, err := mstore.Set(data)
+	require.NoError(t, err)
+
+	n, err := snap.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	_, err = snap.Get(after)
+	assert.EqualError(t, err, "key not found")
+
+	for k, v := range before {
+		got, err := snap.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+
+	seen := make(map[string][]byte)
+	err = snap.ForEach(func(key, value []byte) error {
+		seen[string(key)] = value
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, before, seen)
+
+	snap.Close()
+	_, err = snap.Count()
+	assert.EqualError(t, err, "the snapshot is closed")
+}
+
+func TestSetTyped(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	obj := testStruct()
+	gobData, _ := mstore.GobCodec{}.Marshal(obj)
+	jsonData, _ := mstore.JSONCodec{}.Marshal(obj)
+	raw := []byte("raw bytes")
+
+	values := map[string][]byte{"gob": gobData, "json": jsonData, "raw": raw}
+	keys := make(map[string][]byte)
+	for ct, data := range values {
+		key, err := mstore.SetTyped(ct, data)
+		require.NoError(t, err)
+		keys[ct] = key
+	}
+
+	for ct, key := range keys {
+		gotType, data, err := mstore.GetTyped(key)
+		require.NoError(t, err)
+		assert.Equal(t, ct, gotType)
+		assert.Equal(t, values[ct], data)
+	}
+
+	_, _, err := mstore.GetTyped(make([]byte, 16))
+	assert.EqualError(t, err, "key not found")
+
+	untyped, err := mstore.Set(raw)
+	require.NoError(t, err)
+	_, _, err = mstore.GetTyped(untyped)
+	assert.EqualError(t, err, "value was not stored by SetTyped")
+
+	_, err = mstore.SetTyped("", raw)
+	assert.Error(t, err)
+}
+
+func TestGetByPrefix(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	data, _ := mstore.Marshal(testStruct())
+	require.NoError(t, mstore.SetWithKey([]byte("bucket-a:1"), data))
+	require.NoError(t, mstore.SetWithKey([]byte("bucket-a:2"), data))
+	require.NoError(t, mstore.SetWithKey([]byte("bucket-b:1"), data))
+
+	entries, err := mstore.GetByPrefix([]byte("bucket-a:"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for k, v := range entries {
+		key, err := base64.StdEncoding.DecodeString(k)
+		require.NoError(t, err)
+		assert.Contains(t, string(key), "bucket-a:")
+		assert.Equal(t, data, v)
+	}
+
+	entries, err = mstore.GetByPrefix([]byte("bucket-c:"))
+	require.NoError(t, err)
+	assert.NotNil(t, entries)
+	assert.Empty(t, entries)
+}
+
+func TestScan(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, mstore.SetWithKey([]byte(k), []byte("value-"+k)))
+	}
+
+	var seen []string
+	err := mstore.Scan([]byte("b"), []byte("d"), func(k, v []byte) error {
+		assert.Equal(t, "value-"+string(k), string(v))
+		seen = append(seen, string(k))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, seen)
+
+	seen = nil
+	err = mstore.Scan(nil, nil, func(k, v []byte) error {
+		seen = append(seen, string(k))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, seen)
+
+	stop := fmt.Errorf("stop")
+	seen = nil
+	err = mstore.Scan(nil, nil, func(k, v []byte) error {
+		seen = append(seen, string(k))
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"a"}, seen)
+}
+
+func TestGetValueReadFailure(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	// a value flagged as snappy compressed that does not decode
+	key := []byte("corrupt")
+	d, _ := mstore.DB()
+	err := d.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(key, []byte{1, 0xff, 0xff}).WithMeta(1 << 5))
+	})
+	require.NoError(t, err)
+
+	got, err := mstore.Get(key)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, mstore.ErrNotFound))
+	assert.Nil(t, got)
+
+	_, _, err = mstore.GetWithMeta(key)
+	assert.Error(t, err)
+}
+
+func TestGetBatchValuesStable(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 64+i)
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		want[base64.StdEncoding.EncodeToString(key)] = append([]byte{}, data...)
+	}
+
+	got, err := mstore.GetBatch()
+	require.NoError(t, err)
+
+	// churn the store so badger reuses its buffers
+	for i := 0; i < 50; i++ {
+		_, err := mstore.Set(bytes.Repeat([]byte{byte(i), 0xff}, 64))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mstore.DropAll())
+
+	assert.Equal(t, want, got)
+}
+
+func TestForEach(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		key, err := mstore.Set(data)
+		require.NoError(t, err)
+		want[string(key)] = data
+	}
+
+	got := make(map[string][]byte)
+	err := mstore.ForEach(func(key, value []byte) error {
+		got[string(key)] = value
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = mstore.ForEach(func(key, value []byte) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = mstore.ForEach(func(key, value []byte) error {
+		calls++
+		if calls == 2 {
+			return mstore.ErrStop
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	err = mstore.Scan(nil, nil, func(k, v []byte) error {
+		calls++
+		return mstore.ErrStop
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestReplacePrefix(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	dataset := func(version string, n int) []mstore.KVPair {
+		entries := make([]mstore.KVPair, n)
+		for i := range entries {
+			entries[i] = mstore.KVPair{
+				Key:   []byte(fmt.Sprintf("dataset:%s:%d", version, i)),
+				Value: []byte(version),
+			}
+		}
+		return entries
+	}
+
+	require.NoError(t, mstore.SetWithKey([]byte("other:1"), []byte("kept")))
+	require.NoError(t, mstore.ReplacePrefix([]byte("dataset:"), dataset("v1", 10)))
+
+	// a reader must only ever see one complete version
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			entries, err := mstore.GetByPrefix([]byte("dataset:"))
+			assert.NoError(t, err)
+			versions := make(map[string]int)
+			for _, v := range entries {
+				versions[string(v)]++
+			}
+			assert.Len(t, versions, 1)
+			for v, n := range versions {
+				assert.Equal(t, map[string]int{"v1": 10, "v2": 4}[v], n)
+			}
+		}
+	}()
+
+	require.NoError(t, mstore.ReplacePrefix([]byte("dataset:"), dataset("v2", 4)))
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	entries, err := mstore.GetByPrefix([]byte("dataset:"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	kept, err := mstore.Get([]byte("other:1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("kept"), kept)
+
+	err = mstore.ReplacePrefix([]byte("dataset:"), []mstore.KVPair{{Key: []byte("other:2")}})
+	assert.Error(t, err)
+}
+
+func TestPurgePrefix(t *testing.T) {
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	for i := 0; i < 5; i++ {
+		data, _ := mstore.Marshal(testStruct())
+		require.NoError(t, mstore.SetWithKey([]byte(fmt.Sprintf("tenant-a:%d", i)), data))
+		require.NoError(t, mstore.SetWithKey([]byte(fmt.Sprintf("tenant-b:%d", i)), data))
+	}
+
+	dropped, err := mstore.PurgePrefix([]byte("tenant-a:"))
+	require.NoError(t, err)
+	assert.Greater(t, dropped, int64(0))
+
+	// nothing is left to drop the second time
+	dropped, err = mstore.PurgePrefix([]byte("tenant-a:"))
+	require.NoError(t, err)
+	assert.Zero(t, dropped)
+
+	keys, err := mstore.Keys()
+	require.NoError(t, err)
+	assert.Len(t, keys, 5)
+	for _, k := range keys {
+		assert.Contains(t, string(k), "tenant-b:")
+	}
+
+	_, err = mstore.PurgePrefix(nil)
+	assert.Error(t, err)
+}
+
+func TestPurgePrefixPersistent(t *testing.T) {
+	require.NoError(t, mstore.InitPersistentMode())
+	defer os.RemoveAll(mstore.STORAGE_PATH)
+	defer mstore.Close()
+
+	for i := 0; i < 100; i++ {
+		data := []byte(strings.Repeat(fmt.Sprintf("%d", i), 1024))
+		require.NoError(t, mstore.SetWithKey([]byte(fmt.Sprintf("purge:%d", i)), data))
+	}
+
+	// value log GC runs until badger reports nothing left to rewrite
+	dropped, err := mstore.PurgePrefix([]byte("purge:"))
+	require.NoError(t, err)
+	assert.Greater(t, dropped, int64(100*1024))
+
+	n, err := mstore.CountPrefix([]byte("purge:"))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func testAfterClosed(t *testing.T) {
+	mstore.Close()
+
+	s, err := mstore.Set(make([]byte, 16))
+	assert.Errorf(t, err, "the storage is not open")
+	assert.Nil(t, s)
+
+	b, err := mstore.GetBatch()
+	assert.Errorf(t, err, "the storage is not open")
 	assert.Nil(t, b)
 
+	n, err := mstore.Count()
+	assert.Errorf(t, err, "the storage is not open")
+	assert.Zero(t, n)
+
+	ks, err := mstore.Keys()
+	assert.Errorf(t, err, "the storage is not open")
+	assert.Nil(t, ks)
+
 	o, err := mstore.Get(make([]byte, 16))
 	assert.Errorf(t, err, "the storage is not open")
 	assert.Nil(t, o)
 
 	err = mstore.Remove(make([]byte, 16))
 	assert.Errorf(t, err, "the storage is not open")
+	assert.ErrorIs(t, err, mstore.ErrStoreClosed)
+
+	keys := [][]byte{make([]byte, 16), []byte("other")}
+	ok, errs := mstore.RemoveBatch(keys)
+	assert.False(t, ok)
+	require.Len(t, errs, len(keys))
+	for _, k := range keys {
+		assert.ErrorIs(t, errs[base64.StdEncoding.EncodeToString(k)], mstore.ErrStoreClosed)
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	require.NoError(b, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	values := benchValues(b.N)
+	b.ResetTimer()
+	for _, v := range values {
+		if _, err := mstore.Set(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetBatch(b *testing.B) {
+	require.NoError(b, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	values := benchValues(b.N)
+	b.ResetTimer()
+	if _, errs := mstore.SetBatch(values); len(errs) > 0 {
+		b.Fatal(errs)
+	}
+}
+
+func BenchmarkSetDuplicates(b *testing.B) {
+	for _, size := range []int{0, 100} {
+		b.Run(fmt.Sprintf("window=%d", size), func(b *testing.B) {
+			require.NoError(b, mstore.InitDisklessModeWithOptions(mstore.Options{DedupWindow: size}))
+			defer mstore.Close()
+
+			// a stream where each event is delivered ten times
+			values := benchValues(b.N/10 + 1)
+			before := mstore.Lookups()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mstore.Set(values[i/10])
+			}
+			b.ReportMetric(float64(mstore.Lookups()-before)/float64(b.N), "lookups/op")
+		})
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	require.NoError(b, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	values := benchValues(b.N)
+	b.ResetTimer()
+	if _, err := mstore.BulkLoad(values); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchValues(n int) [][]byte {
+	values := make([][]byte, n)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("value-%d-%d", i, time.Now().UnixNano()))
+	}
+	return values
 }
@@ -0,0 +1,100 @@
+package mstore
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Txn is a transaction passed to the functions given to Update and ViewTxn.
+// It must not be used after the function returns.
+type Txn struct {
+	txn     *badger.Txn
+	written [][]byte
+}
+
+// Set writes data under key, replacing any existing value.
+func (t *Txn) Set(key, data []byte) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if err := t.txn.SetEntry(newEntry(key, data)); err != nil {
+		return err
+	}
+	t.written = append(t.written, key)
+	return nil
+}
+
+// Get returns the value stored under key, or ErrNotFound.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrInvalidKey
+	}
+	item, err := t.txn.Get(key)
+	if err != nil {
+		return nil, missing(t.txn, key, err)
+	}
+	return itemValue(item)
+}
+
+// Delete removes key. It is not an error when the key does not exist.
+func (t *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if err := t.txn.Delete(key); err != nil {
+		return err
+	}
+	t.written = append(t.written, key)
+	return nil
+}
+
+// Has reports whether key exists.
+func (t *Txn) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrInvalidKey
+	}
+	_, err := t.txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Update runs fn in a read-write transaction that is committed when fn
+// returns nil and discarded otherwise, so that the writes it makes are
+// applied all together or not at all. When the commit conflicts with a
+// concurrent writer fn is run again in a new transaction, so it should not
+// have side effects outside of tx.
+func Update(fn func(tx *Txn) error) error {
+	if err := wlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	var tx Txn
+	err := update(func(txn *badger.Txn) error {
+		tx = Txn{txn: txn}
+		return fn(&tx)
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range tx.written {
+		window.remove(k)
+	}
+	return nil
+}
+
+// ViewTxn runs fn in a read-only transaction, giving it a consistent view of
+// the store. Writes made through tx fail.
+func ViewTxn(fn func(tx *Txn) error) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.View(func(txn *badger.Txn) error {
+		return fn(&Txn{txn: txn})
+	})
+}
@@ -0,0 +1,272 @@
+package mstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Bits of badger's per-entry user meta byte recording how mstore framed the
+// stored value, so it can be read back regardless of the current Options.
+const (
+	// metaModTime marks a value prefixed with its modification time as
+	// 8 byte big-endian unix nanoseconds.
+	metaModTime byte = 1 << 7
+
+	// metaTyped marks a value written by SetTyped, framed with its
+	// content type.
+	metaTyped byte = 1 << 6
+
+	// metaCompressed marks a value compressed as Options.Compression
+	// selects, prefixed with the Compression used.
+	metaCompressed byte = 1 << 5
+
+	// metaStream marks the manifest of a value written by SetStream.
+	metaStream byte = 1 << 4
+)
+
+// UserMetaMask holds the bits of the user meta byte that SetWithMeta may
+// set. The remaining bits are reserved by mstore.
+const UserMetaMask byte = metaStream - 1
+
+// newEntry builds the entry that stores data under key, framing the value
+// and setting its TTL as the store's Options require.
+func newEntry(key, data []byte) *badger.Entry {
+	var meta byte
+	if options.Compression != CompressionNone {
+		var ok bool
+		if data, ok = compress(options.Compression, data); ok {
+			meta |= metaCompressed
+		}
+	}
+	if options.TrackModTime {
+		framed := make([]byte, 8+len(data))
+		binary.BigEndian.PutUint64(framed, uint64(time.Now().UnixNano()))
+		copy(framed[8:], data)
+		data = framed
+		meta |= metaModTime
+	}
+	e := badger.NewEntry(key, data).WithMeta(meta)
+	if options.DefaultTTL > 0 {
+		e = e.WithTTL(options.DefaultTTL)
+	}
+	return e
+}
+
+// decodeValue strips mstore's framing, described by meta, from a stored
+// value. The returned data may share memory with raw. modTime is zero when
+// the value was written without Options.TrackModTime.
+func decodeValue(meta byte, raw []byte) (data []byte, modTime time.Time, err error) {
+	data = raw
+	if meta&metaModTime != 0 {
+		if len(data) < 8 {
+			return nil, time.Time{}, errors.New("stored value is corrupt")
+		}
+		modTime = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+		data = data[8:]
+	}
+	if meta&metaCompressed != 0 {
+		if data, err = decompress(data); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return data, modTime, nil
+}
+
+// itemValue returns a copy of the item's value without mstore's framing.
+func itemValue(item *badger.Item) ([]byte, error) {
+	raw, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := decodeValue(item.UserMeta(), raw)
+	return data, err
+}
+
+// Meta describes a stored entry.
+type Meta struct {
+	// ExpiresAt is when the entry expires, or zero when it has no TTL.
+	ExpiresAt time.Time
+
+	// ModTime is when the entry was written, or zero when it was written
+	// without Options.TrackModTime.
+	ModTime time.Time
+
+	// Version is the badger version of the entry, which increases with
+	// every write.
+	Version uint64
+
+	// UserMeta is the tag the entry was stored with by SetWithMeta, or zero.
+	UserMeta byte
+}
+
+// GetWithMeta retrieves the value stored under key along with its Meta, for
+// example to refresh entries shortly before they expire.
+func GetWithMeta(key []byte) (data []byte, meta Meta, err error) {
+	if err := rlock(); err != nil {
+		return nil, meta, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return nil, meta, ErrInvalidKey
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return missing(txn, key, err)
+		}
+
+		raw, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		data, meta.ModTime, err = decodeValue(item.UserMeta(), raw)
+		if err != nil {
+			return err
+		}
+
+		if exp := item.ExpiresAt(); exp > 0 {
+			meta.ExpiresAt = time.Unix(int64(exp), 0)
+		}
+		meta.Version = item.Version()
+		meta.UserMeta = item.UserMeta() & UserMetaMask
+		return nil
+	})
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return data, meta, nil
+}
+
+// SetWithMeta stores data as Set does, tagged with meta, which GetWithMeta
+// returns as Meta.UserMeta. Readers can dispatch on the tag, for example to
+// pick a decoder. Only the bits in UserMetaMask may be set. Like Set, the key
+// is derived from data alone, so the same data cannot be stored twice with
+// different tags.
+func SetWithMeta(data []byte, meta byte) ([]byte, error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	if meta&^UserMetaMask != 0 {
+		return nil, fmt.Errorf("user meta %#x uses bits reserved by mstore", meta)
+	}
+
+	key, err := GenPK(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return set(key, data, meta, nil)
+}
+
+// SetTyped stores data framed with a short contentType, such as "json" or
+// "gob", so a store can hold values of mixed formats and readers can
+// dispatch on the type returned by GetTyped. Like Set, the key is derived
+// from the stored bytes, which include the content type.
+func SetTyped(contentType string, data []byte) ([]byte, error) {
+	if err := wlock(); err != nil {
+		return nil, err
+	}
+	defer mu.RUnlock()
+
+	if len(contentType) == 0 || len(contentType) > 255 {
+		return nil, errors.New("content type must be between 1 and 255 bytes")
+	}
+
+	framed := make([]byte, 0, 1+len(contentType)+len(data))
+	framed = append(framed, byte(len(contentType)))
+	framed = append(framed, contentType...)
+	framed = append(framed, data...)
+
+	key, err := GenPK(framed)
+	if err != nil {
+		return nil, err
+	}
+
+	return set(key, framed, metaTyped, nil)
+}
+
+// GetTyped retrieves a value stored by SetTyped along with its content type.
+func GetTyped(key []byte) (contentType string, data []byte, err error) {
+	if err := rlock(); err != nil {
+		return "", nil, err
+	}
+	defer mu.RUnlock()
+
+	if len(key) == 0 {
+		return "", nil, ErrInvalidKey
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return missing(txn, key, err)
+		}
+
+		if item.UserMeta()&metaTyped == 0 {
+			return errors.New("value was not stored by SetTyped")
+		}
+
+		framed, err := itemValue(item)
+		if err != nil {
+			return err
+		}
+
+		if len(framed) == 0 || len(framed) < 1+int(framed[0]) {
+			return errors.New("stored value is corrupt")
+		}
+		n := int(framed[0])
+		contentType = string(framed[1 : 1+n])
+		data = framed[1+n:]
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
+
+// ModifiedSince calls fn with every entry modified after since, stopping at
+// and returning the first error fn returns. Only entries written while
+// Options.TrackModTime was enabled carry a modification time; all others
+// are skipped.
+func ModifiedSince(since time.Time, fn func(key, value []byte) error) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	defer mu.RUnlock()
+
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.UserMeta()&metaModTime == 0 {
+				continue
+			}
+			raw, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			data, modTime, err := decodeValue(item.UserMeta(), raw)
+			if err != nil {
+				return err
+			}
+			if !modTime.After(since) {
+				continue
+			}
+			if err := fn(item.KeyCopy(nil), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,104 @@
+package mstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// watches holds the cancel function of every running Watch, so that Close
+// can end them.
+var (
+	watchMu sync.Mutex
+	watchID uint64
+	watches = make(map[uint64]context.CancelFunc)
+)
+
+// addWatch registers the cancel function of a Watch and returns its id. The
+// lock must be held, so that Close either ran before or will cancel it.
+func addWatch(cancel context.CancelFunc) uint64 {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	watchID++
+	watches[watchID] = cancel
+	return watchID
+}
+
+// removeWatch forgets the Watch with the given id.
+func removeWatch(id uint64) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	delete(watches, id)
+}
+
+// stopWatches cancels every running Watch. The lock must be held for
+// writing.
+func stopWatches() {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+
+	for id, cancel := range watches {
+		cancel()
+		delete(watches, id)
+	}
+}
+
+// Watch calls cb for every write to a key starting with prefix until ctx is
+// cancelled or the store is closed. A removal is reported with a nil value.
+// Watch blocks, so it is usually run in its own goroutine, and it returns
+// ctx.Err() when cancelled and nil when the store is closed under it.
+func Watch(ctx context.Context, prefix []byte, cb func(key, value []byte)) error {
+	return WatchPrefixes(ctx, [][]byte{prefix}, cb)
+}
+
+// WatchPrefixes is Watch for writes to keys starting with any of prefixes.
+// Each write is reported once, even when it matches several prefixes. No
+// prefixes watches every key.
+func WatchPrefixes(ctx context.Context, prefixes [][]byte, cb func(key, value []byte)) error {
+	if err := rlock(); err != nil {
+		return err
+	}
+	// The subscription outlives the read lock so Close is not blocked by it,
+	// and is cancelled by Close instead.
+	d := db
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer removeWatch(addWatch(cancel))
+	mu.RUnlock()
+
+	matches := []pb.Match{{}}
+	if len(prefixes) > 0 {
+		matches = make([]pb.Match, len(prefixes))
+		for i, p := range prefixes {
+			matches[i] = pb.Match{Prefix: p}
+		}
+	}
+
+	err := d.Subscribe(wctx, func(kvs *badger.KVList) error {
+		for _, kv := range kvs.Kv {
+			// badger publishes an entry's user meta in the Meta field.
+			var meta byte
+			if len(kv.Meta) > 0 {
+				meta = kv.Meta[0]
+			}
+			value, _, err := decodeValue(meta, kv.Value)
+			if err != nil {
+				return err
+			}
+			if len(value) == 0 {
+				value = nil
+			}
+			cb(kv.Key, value)
+		}
+		return nil
+	}, matches)
+	if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+		// cancelled by Close
+		return nil
+	}
+	return err
+}
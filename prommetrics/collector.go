@@ -0,0 +1,58 @@
+// Package prommetrics exports mstore's operation counters and store size as
+// Prometheus metrics.
+package prommetrics
+
+import (
+	"github.com/MCGHealth/mstore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollector is a prometheus.Collector reporting the mstore operation
+// counters and the size of the open store. It reads the package level store,
+// so register a single collector per process.
+type MetricsCollector struct {
+	sets     *prometheus.Desc
+	gets     *prometheus.Desc
+	removes  *prometheus.Desc
+	errors   *prometheus.Desc
+	lsmSize  *prometheus.Desc
+	vlogSize *prometheus.Desc
+}
+
+// NewMetricsCollector returns a collector ready to be registered, e.g. with
+// prometheus.MustRegister.
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{
+		sets:     prometheus.NewDesc("mstore_sets_total", "Number of Set calls.", nil, nil),
+		gets:     prometheus.NewDesc("mstore_gets_total", "Number of Get calls.", nil, nil),
+		removes:  prometheus.NewDesc("mstore_removes_total", "Number of Remove calls.", nil, nil),
+		errors:   prometheus.NewDesc("mstore_errors_total", "Number of failed Set, Get and Remove calls.", nil, nil),
+		lsmSize:  prometheus.NewDesc("mstore_lsm_size_bytes", "Size of the LSM tree in bytes.", nil, nil),
+		vlogSize: prometheus.NewDesc("mstore_vlog_size_bytes", "Size of the value log in bytes.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sets
+	ch <- c.gets
+	ch <- c.removes
+	ch <- c.errors
+	ch <- c.lsmSize
+	ch <- c.vlogSize
+}
+
+// Collect implements prometheus.Collector. The size gauges are only reported
+// while the store is open.
+func (c *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	ops := mstore.Ops()
+	ch <- prometheus.MustNewConstMetric(c.sets, prometheus.CounterValue, float64(ops.Sets))
+	ch <- prometheus.MustNewConstMetric(c.gets, prometheus.CounterValue, float64(ops.Gets))
+	ch <- prometheus.MustNewConstMetric(c.removes, prometheus.CounterValue, float64(ops.Removes))
+	ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(ops.Errors))
+
+	if lsm, vlog, err := mstore.Size(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.lsmSize, prometheus.GaugeValue, float64(lsm))
+		ch <- prometheus.MustNewConstMetric(c.vlogSize, prometheus.GaugeValue, float64(vlog))
+	}
+}
@@ -0,0 +1,52 @@
+package prommetrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MCGHealth/mstore"
+	"github.com/MCGHealth/mstore/prommetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	c := prommetrics.NewMetricsCollector()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+
+	// Only the counters are reported while the store is closed.
+	assert.Equal(t, 4, testutil.CollectAndCount(c))
+
+	require.NoError(t, mstore.InitDisklessMode())
+	defer mstore.Close()
+
+	key, err := mstore.Set([]byte("some data"))
+	require.NoError(t, err)
+	_, err = mstore.Get(key)
+	require.NoError(t, err)
+	require.NoError(t, mstore.Remove(key))
+	_, err = mstore.Get(nil)
+	require.Error(t, err)
+
+	assert.Equal(t, 6, testutil.CollectAndCount(c))
+
+	want := `
+# HELP mstore_errors_total Number of failed Set, Get and Remove calls.
+# TYPE mstore_errors_total counter
+mstore_errors_total 1
+# HELP mstore_gets_total Number of Get calls.
+# TYPE mstore_gets_total counter
+mstore_gets_total 2
+# HELP mstore_removes_total Number of Remove calls.
+# TYPE mstore_removes_total counter
+mstore_removes_total 1
+# HELP mstore_sets_total Number of Set calls.
+# TYPE mstore_sets_total counter
+mstore_sets_total 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want),
+		"mstore_sets_total", "mstore_gets_total", "mstore_removes_total", "mstore_errors_total"))
+}